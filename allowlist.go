@@ -0,0 +1,190 @@
+package weixin
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default interval of refreshing callback ip list
+	ipListRefreshInterval = time.Hour
+	// Interval of getting callback ip list again after failure
+	ipListRetryInterval = time.Minute
+)
+
+// ipAllowlist accept the callback requests from weixin servers only.
+type ipAllowlist struct {
+	wx       *Weixin
+	refresh  time.Duration
+	proxies  []*net.IPNet
+	nets     atomic.Value // []*net.IPNet
+	mutex    sync.Mutex
+	failed   time.Time
+	fetching chan struct{} // closed when the fetch in progress is done
+}
+
+// WithCallbackIPAllowlist reject the callback requests not from weixin
+// servers, the ip list is fetched by GetIpList when New is called and
+// refreshed every refresh (1 hour if not positive).
+// If the service is behind reverse proxies, the client ip is read from
+// X-Forwarded-For or X-Real-IP when the request is from trustedProxies
+// (ip or CIDR).
+func WithCallbackIPAllowlist(refresh time.Duration, trustedProxies ...string) Option {
+	return func(wx *Weixin) {
+		if refresh <= 0 {
+			refresh = ipListRefreshInterval
+		}
+		a := &ipAllowlist{wx: wx, refresh: refresh}
+		for _, proxy := range trustedProxies {
+			if ipNet := parseIPNet(proxy); ipNet != nil {
+				a.proxies = append(a.proxies, ipNet)
+			} else {
+				log.Println("Weixin invalid trusted proxy:", proxy)
+			}
+		}
+		a.nets.Store([]*net.IPNet{})
+		wx.ipAllowlist = a
+	}
+}
+
+// parseIPNet parse ip or CIDR.
+func parseIPNet(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return ipNet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP return the ip of the request sender, skip the trusted proxies.
+func (a *ipAllowlist) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(a.proxies, ip) {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+		// The rightmost address not of trusted proxies is the client.
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip = net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil || !containsIP(a.proxies, ip) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+// fetch start getting the ip list in background unless it is in progress,
+// and return the channel closed when it is done, or nil if it failed within
+// ipListRetryInterval and force is false. The last list is kept on failure.
+func (a *ipAllowlist) fetch(force bool) chan struct{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.fetching != nil {
+		return a.fetching
+	}
+	if !force && time.Since(a.failed) < ipListRetryInterval {
+		return nil
+	}
+	done := make(chan struct{})
+	a.fetching = done
+	go func() {
+		ctx, cancel := a.wx.backgroundContext()
+		defer cancel()
+		ips, err := a.wx.GetIpListContext(ctx)
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		defer close(done)
+		a.fetching = nil
+		if err != nil {
+			a.failed = time.Now()
+			log.Println("Weixin update callback ip list failed:", err)
+			return
+		}
+		nets := make([]*net.IPNet, 0, len(ips))
+		for _, s := range ips {
+			if ipNet := parseIPNet(s); ipNet != nil {
+				nets = append(nets, ipNet)
+			}
+		}
+		a.nets.Store(nets)
+	}()
+	return done
+}
+
+// run fetch the ip list at once and refresh it periodically until the
+// instance is closed.
+func (a *ipAllowlist) run() {
+	a.fetch(true)
+	ticker := time.NewTicker(a.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.wx.done:
+			return
+		case <-ticker.C:
+			a.fetch(true)
+		}
+	}
+}
+
+// load return the ip list, wait for the fetch in progress if there is none,
+// or start one but not within ipListRetryInterval after failure, so the
+// callbacks do not exhaust the quota of GetIpList.
+func (a *ipAllowlist) load(ctx context.Context) []*net.IPNet {
+	if nets := a.nets.Load().([]*net.IPNet); len(nets) > 0 {
+		return nets
+	}
+	if done := a.fetch(false); done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		case <-a.wx.done:
+		}
+	}
+	return a.nets.Load().([]*net.IPNet)
+}
+
+// allow check the request is from weixin servers.
+func (a *ipAllowlist) allow(r *http.Request) bool {
+	ip := a.clientIP(r)
+	if ip == nil {
+		return false
+	}
+	return containsIP(a.load(r.Context()), ip)
+}
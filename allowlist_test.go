@@ -0,0 +1,80 @@
+package weixin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newIPListServer stub the token and getcallbackip API, the ip list is
+// returned after delay and the calls are counted.
+func newIPListServer(calls *int32, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case weixinCgiBin + "/token":
+			w.Write([]byte(`{"access_token":"token","expires_in":7200}`)) // nolint
+		case weixinCgiBin + "/getcallbackip":
+			atomic.AddInt32(calls, 1)
+			time.Sleep(delay)
+			w.Write([]byte(`{"ip_list":["192.0.2.1","198.51.100.0/24"]}`)) // nolint
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// verifyRequest create the url verification request from remoteAddr.
+func verifyRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest("GET", "/?signature="+Signature("token", "1409304348", "nonce")+
+		"&timestamp=1409304348&nonce=nonce&echostr=echo", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestIPAllowlistConcurrentFirstRequests(t *testing.T) {
+	var calls int32
+	srv := newIPListServer(&calls, 50*time.Millisecond)
+	defer srv.Close()
+	wx := New("token", "appid", "secret", WithAPIHost(srv.URL), WithCallbackIPAllowlist(0))
+	defer wx.Close() // nolint
+	addrs := []string{"192.0.2.1:1234", "198.51.100.7:1234", "192.0.2.1:1234", "198.51.100.8:1234", "203.0.113.1:1234"}
+	want := []int{200, 200, 200, 200, 403}
+	codes := make([]int, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			wx.ServeHTTP(w, verifyRequest(addr))
+			codes[i] = w.Code
+		}(i, addr)
+	}
+	wg.Wait()
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("got status %v, want %v", codes, want)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("getcallbackip called %d times, want 1", calls)
+	}
+}
+
+func TestIPAllowlistPrefetch(t *testing.T) {
+	var calls int32
+	srv := newIPListServer(&calls, 0)
+	defer srv.Close()
+	wx := New("token", "appid", "secret", WithAPIHost(srv.URL), WithCallbackIPAllowlist(0))
+	defer wx.Close() // nolint
+	for i := 0; i < 100 && len(wx.ipAllowlist.nets.Load().([]*net.IPNet)) <= 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nets := wx.ipAllowlist.nets.Load().([]*net.IPNet); len(nets) != 2 {
+		t.Fatalf("got ip list %v before any request, want 2 entries", nets)
+	}
+}
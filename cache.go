@@ -0,0 +1,87 @@
+package weixin
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Interval of removing expired items in memory cache
+	memoryCacheSweepInterval = time.Minute
+)
+
+// Cache is a key value cache with expiration, it is used to remember
+// callback nonces and messages, implement it with Redis or memcached to
+// share between instances.
+type Cache interface {
+	// Add set the value of key only if the key does not exist, return
+	// false if the key exists.
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	// Get return the value of key, false if the key does not exist.
+	Get(key string) ([]byte, bool, error)
+	// Set set the value of key.
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+type memoryCacheItem struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	mutex     sync.Mutex
+	items     map[string]memoryCacheItem
+	lastSweep time.Time
+}
+
+// NewMemoryCache create a cache in memory.
+func NewMemoryCache() Cache {
+	return &memoryCache{
+		items:     make(map[string]memoryCacheItem),
+		lastSweep: time.Now(),
+	}
+}
+
+// sweep remove expired items, must be called with mutex locked.
+func (c *memoryCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < memoryCacheSweepInterval {
+		return
+	}
+	for key, item := range c.items {
+		if now.After(item.expires) {
+			delete(c.items, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *memoryCache) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	if item, ok := c.items[key]; ok && now.Before(item.expires) {
+		return false, nil
+	}
+	c.items[key] = memoryCacheItem{value, now.Add(ttl)}
+	return true, nil
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expires) {
+		return nil, false, nil
+	}
+	return item.value, true, nil
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	c.items[key] = memoryCacheItem{value, now.Add(ttl)}
+	return nil
+}
@@ -0,0 +1,219 @@
+package weixin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error code of message crypto, same as WXBizMsgCrypt.
+// nolint
+const (
+	CryptErrValidateSignature = -40001
+	CryptErrParseXml          = -40002
+	CryptErrComputeSignature  = -40003
+	CryptErrIllegalAesKey     = -40004
+	CryptErrValidateAppId     = -40005
+	CryptErrEncryptAES        = -40006
+	CryptErrDecryptAES        = -40007
+	CryptErrIllegalBuffer     = -40008
+	CryptErrEncodeBase64      = -40009
+	CryptErrDecodeBase64      = -40010
+	CryptErrGenReturnXml      = -40011
+)
+
+const (
+	// WeiXin pads the plaintext to a multiple of 32 bytes
+	cryptBlockSize = 32
+	// Length of EncodingAESKey
+	encodingAESKeyLen = 43
+)
+
+// CryptError is the error of message crypto.
+type CryptError struct {
+	Code int
+	Err  error
+}
+
+// Error return the error message.
+func (e *CryptError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("WeiXin crypt error[%d]: %v", e.Code, e.Err)
+	}
+	return fmt.Sprintf("WeiXin crypt error[%d]", e.Code)
+}
+
+// Unwrap return the underlying error.
+func (e *CryptError) Unwrap() error {
+	return e.Err
+}
+
+func newCryptError(code int, err error) error {
+	return &CryptError{code, err}
+}
+
+// MsgCrypt encrypt and decrypt messages in safe mode, compatible with WXBizMsgCrypt.
+type MsgCrypt struct {
+	token string
+	key   []byte
+	appID string
+}
+
+type encryptedMsg struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   string   `xml:"ToUserName,omitempty"`
+	Encrypt      string   `xml:"Encrypt"`
+	MsgSignature string   `xml:"MsgSignature,omitempty"`
+	TimeStamp    string   `xml:"TimeStamp,omitempty"`
+	Nonce        string   `xml:"Nonce,omitempty"`
+}
+
+// NewMsgCrypt create a MsgCrypt, the app id in decrypted message is not
+// checked if appID is empty.
+func NewMsgCrypt(token string, encodingAESKey string, appID string) (*MsgCrypt, error) {
+	if len(encodingAESKey) != encodingAESKeyLen {
+		return nil, newCryptError(CryptErrIllegalAesKey, nil)
+	}
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, newCryptError(CryptErrIllegalAesKey, err)
+	}
+	return &MsgCrypt{token, key, appID}, nil
+}
+
+// Signature return the sha1 signature of sorted strs.
+func Signature(strs ...string) string {
+	s := make([]string, len(strs))
+	copy(s, strs)
+	sort.Strings(s)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(s, ""))))
+}
+
+// Signature return the message signature.
+func (c *MsgCrypt) Signature(timestamp string, nonce string, encrypt string) string {
+	return Signature(c.token, timestamp, nonce, encrypt)
+}
+
+func (c *MsgCrypt) verifySignature(signature string, timestamp string, nonce string, encrypt string) error {
+	if subtle.ConstantTimeCompare([]byte(c.Signature(timestamp, nonce, encrypt)), []byte(signature)) != 1 {
+		return newCryptError(CryptErrValidateSignature, nil)
+	}
+	return nil
+}
+
+// Encrypt encrypt msg and return in base64.
+func (c *MsgCrypt) Encrypt(msg []byte) (string, error) {
+	b, err := aes.NewCipher(c.key)
+	if err != nil {
+		return "", newCryptError(CryptErrEncryptAES, err)
+	}
+	// random(16) + msg_len(4) + msg + appid
+	buf := make([]byte, 20, 20+len(msg)+len(c.appID)+cryptBlockSize)
+	if _, err := rand.Read(buf[:16]); err != nil {
+		return "", newCryptError(CryptErrEncryptAES, err)
+	}
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(msg)))
+	buf = append(buf, msg...)
+	buf = append(buf, c.appID...)
+	padding := cryptBlockSize - len(buf)%cryptBlockSize
+	buf = append(buf, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(b, c.key[:aes.BlockSize]).CryptBlocks(buf, buf)
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Decrypt decrypt the base64 encrypted message, check the padding and app id.
+func (c *MsgCrypt) Decrypt(encrypt string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, newCryptError(CryptErrDecodeBase64, err)
+	}
+	if len(data) <= 0 || len(data)%aes.BlockSize != 0 {
+		return nil, newCryptError(CryptErrDecryptAES, nil)
+	}
+	b, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, newCryptError(CryptErrDecryptAES, err)
+	}
+	cipher.NewCBCDecrypter(b, c.key[:aes.BlockSize]).CryptBlocks(data, data)
+	// PKCS7 padding
+	padding := int(data[len(data)-1])
+	if padding < 1 || padding > cryptBlockSize || padding > len(data) {
+		return nil, newCryptError(CryptErrIllegalBuffer, nil)
+	}
+	for _, p := range data[len(data)-padding:] {
+		if int(p) != padding {
+			return nil, newCryptError(CryptErrIllegalBuffer, nil)
+		}
+	}
+	data = data[:len(data)-padding]
+	if len(data) < 20 {
+		return nil, newCryptError(CryptErrIllegalBuffer, nil)
+	}
+	msgLen := uint64(binary.BigEndian.Uint32(data[16:20]))
+	if 20+msgLen > uint64(len(data)) {
+		return nil, newCryptError(CryptErrIllegalBuffer, nil)
+	}
+	msg := data[20 : 20+msgLen]
+	if len(c.appID) > 0 && subtle.ConstantTimeCompare(data[20+msgLen:], []byte(c.appID)) != 1 {
+		return nil, newCryptError(CryptErrValidateAppId, nil)
+	}
+	return msg, nil
+}
+
+// EncryptMsg encrypt the reply message to the xml with Encrypt, MsgSignature,
+// TimeStamp and Nonce, the current time and a random nonce are used if empty.
+func (c *MsgCrypt) EncryptMsg(msg []byte, timestamp string, nonce string) ([]byte, error) {
+	encrypt, err := c.Encrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(timestamp) <= 0 {
+		timestamp = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	if len(nonce) <= 0 {
+		nonce = randomString(10)
+	}
+	reply := fmt.Sprintf(replyEncrypt, encrypt, c.Signature(timestamp, nonce, encrypt), timestamp, nonce)
+	return []byte(reply), nil
+}
+
+// DecryptMsg verify the signature of the message xml and decrypt it.
+func (c *MsgCrypt) DecryptMsg(msgSignature string, timestamp string, nonce string, data []byte) ([]byte, error) {
+	var msg encryptedMsg
+	if err := xml.Unmarshal(data, &msg); err != nil {
+		return nil, newCryptError(CryptErrParseXml, err)
+	}
+	if err := c.verifySignature(msgSignature, timestamp, nonce, msg.Encrypt); err != nil {
+		return nil, err
+	}
+	return c.Decrypt(msg.Encrypt)
+}
+
+// VerifyURL verify the signature of the url verification request and return
+// the decrypted echostr.
+func (c *MsgCrypt) VerifyURL(msgSignature string, timestamp string, nonce string, echoStr string) ([]byte, error) {
+	if err := c.verifySignature(msgSignature, timestamp, nonce, echoStr); err != nil {
+		return nil, err
+	}
+	return c.Decrypt(echoStr)
+}
+
+func randomString(n int) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	rand.Read(b) // nolint
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b)
+}
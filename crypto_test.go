@@ -0,0 +1,140 @@
+package weixin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Test vector of WXBizMsgCrypt.
+const (
+	testCryptToken   = "pamtest"
+	testCryptKey     = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	testCryptAppID   = "wxb11529c136998cb6"
+	testCryptMsg     = "我是中文abcd123"
+	testCryptEncrypt = "jn1L23DB+6ELqJ+6bruv21Y6MD7KeIfP82D6gU39rmkgczbWwt5+3bnyg5K55bgVtVzd832WzZGMhkP72vVOfg=="
+)
+
+func newTestMsgCrypt(t *testing.T) *MsgCrypt {
+	c, err := NewMsgCrypt(testCryptToken, testCryptKey, testCryptAppID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// encryptRaw encrypt plain without padding, len(plain) must be a multiple
+// of block size.
+func encryptRaw(c *MsgCrypt, plain []byte) string {
+	b, _ := aes.NewCipher(c.key)
+	data := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(b, c.key[:aes.BlockSize]).CryptBlocks(data, plain)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// pad return random(16) + msg_len(4) + msg + appid padded with padding.
+func pad(msgLen int, msg string, appID string, padding []byte) []byte {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(msgLen))
+	buf = append(buf, msg...)
+	buf = append(buf, appID...)
+	return append(buf, padding...)
+}
+
+func cryptErrorCode(err error) int {
+	var cryptErr *CryptError
+	if errors.As(err, &cryptErr) {
+		return cryptErr.Code
+	}
+	return 0
+}
+
+func TestNewMsgCrypt(t *testing.T) {
+	for _, key := range []string{"", "short", testCryptKey + "A", strings.Repeat("!", encodingAESKeyLen)} {
+		if _, err := NewMsgCrypt(testCryptToken, key, testCryptAppID); cryptErrorCode(err) != CryptErrIllegalAesKey {
+			t.Errorf("key %q: got error %v, want %d", key, err, CryptErrIllegalAesKey)
+		}
+	}
+}
+
+func TestMsgCryptDecryptVector(t *testing.T) {
+	msg, err := newTestMsgCrypt(t).Decrypt(testCryptEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != testCryptMsg {
+		t.Fatalf("got %q, want %q", msg, testCryptMsg)
+	}
+}
+
+func TestMsgCryptDecryptInvalid(t *testing.T) {
+	c := newTestMsgCrypt(t)
+	// 20 + 3 + 18 = 41 bytes, 23 bytes of padding to 64
+	valid := func(padding []byte) string {
+		return encryptRaw(c, pad(3, "abc", testCryptAppID, padding))
+	}
+	inconsistent := bytes.Repeat([]byte{23}, 23)
+	inconsistent[0] = 22
+	cases := []struct {
+		name    string
+		encrypt string
+		code    int
+	}{
+		{"empty", "", CryptErrDecryptAES},
+		{"invalid base64", "!!!", CryptErrDecodeBase64},
+		{"not block aligned", base64.StdEncoding.EncodeToString(make([]byte, 15)), CryptErrDecryptAES},
+		{"zero padding", encryptRaw(c, make([]byte, 32)), CryptErrIllegalBuffer},
+		{"padding over 32", encryptRaw(c, bytes.Repeat([]byte{33}, 48)), CryptErrIllegalBuffer},
+		{"padding over length", encryptRaw(c, bytes.Repeat([]byte{32}, 16)), CryptErrIllegalBuffer},
+		{"inconsistent padding", valid(inconsistent), CryptErrIllegalBuffer},
+		{"too short", encryptRaw(c, bytes.Repeat([]byte{20}, 32)), CryptErrIllegalBuffer},
+		{"msg_len past buffer", encryptRaw(c, pad(1000, "abc", testCryptAppID, bytes.Repeat([]byte{23}, 23))), CryptErrIllegalBuffer},
+		{"msg_len overflow", encryptRaw(c, pad(-1, "abc", testCryptAppID, bytes.Repeat([]byte{23}, 23))), CryptErrIllegalBuffer},
+		{"wrong appid", encryptRaw(c, pad(3, "abc", "wx0000000000000000", bytes.Repeat([]byte{23}, 23))), CryptErrValidateAppId},
+	}
+	for _, tc := range cases {
+		msg, err := c.Decrypt(tc.encrypt)
+		if code := cryptErrorCode(err); code != tc.code {
+			t.Errorf("%s: got %q, %v, want error %d", tc.name, msg, err, tc.code)
+		}
+	}
+	if msg, err := c.Decrypt(valid(bytes.Repeat([]byte{23}, 23))); err != nil || string(msg) != "abc" {
+		t.Errorf("got %q, %v, want abc", msg, err)
+	}
+}
+
+func TestMsgCryptRoundTrip(t *testing.T) {
+	c := newTestMsgCrypt(t)
+	reply := "<xml><Content><![CDATA[" + testCryptMsg + "]]></Content></xml>"
+	data, err := c.EncryptMsg([]byte(reply), "1409304348", "xxxxxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg encryptedMsg
+	if err := xml.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := c.DecryptMsg(msg.MsgSignature, msg.TimeStamp, msg.Nonce, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != reply {
+		t.Fatalf("got %q, want %q", plain, reply)
+	}
+	if _, err := c.DecryptMsg(msg.MsgSignature, msg.TimeStamp, "yyyyyy", data); cryptErrorCode(err) != CryptErrValidateSignature {
+		t.Fatalf("got error %v, want %d", err, CryptErrValidateSignature)
+	}
+	other, err := NewMsgCrypt(testCryptToken, testCryptKey, "wx0000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.DecryptMsg(msg.MsgSignature, msg.TimeStamp, msg.Nonce, data); cryptErrorCode(err) != CryptErrValidateAppId {
+		t.Fatalf("got error %v, want %d", err, CryptErrValidateAppId)
+	}
+}
@@ -0,0 +1,96 @@
+package weixin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errReplyExpired = errors.New("WeiXin reply deadline exceeded")
+
+// WithReplyDeadline reply "success" if the handler does not reply within
+// timeout, weixin show the user an error if no reply in 5 seconds. The
+// handler keeps running, and the later Reply* calls are sent as customer
+// service messages by Post*.
+func WithReplyDeadline(timeout time.Duration) Option {
+	return func(wx *Weixin) {
+		wx.replyTimeout = timeout
+	}
+}
+
+// deadlineWriter drop the writes after the reply deadline, the handler may
+// run after ServeHTTP returns.
+type deadlineWriter struct {
+	writer  http.ResponseWriter
+	mutex   sync.Mutex
+	written bool
+	expired bool
+}
+
+func (w *deadlineWriter) Header() http.Header {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.expired {
+		return http.Header{}
+	}
+	return w.writer.Header()
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.expired {
+		return 0, errReplyExpired
+	}
+	w.written = true
+	return w.writer.Write(data)
+}
+
+func (w *deadlineWriter) WriteHeader(statusCode int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.expired {
+		return
+	}
+	w.written = true
+	w.writer.WriteHeader(statusCode)
+}
+
+// expire reply "success" unless the handler replied already.
+func (w *deadlineWriter) expire() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.written {
+		w.writer.Write([]byte("success")) // nolint
+	}
+	w.expired = true
+}
+
+// handleWithDeadline run handle in background and wait for it until the
+// reply deadline.
+func (wx *Weixin) handleWithDeadline(writer responseWriter, r *Request, handle func(responseWriter, *Request)) {
+	dw := &deadlineWriter{writer: writer.writer}
+	writer.writer = dw
+	done := make(chan struct{})
+	wx.inflight.Add(1)
+	go func() {
+		defer wx.inflight.Done()
+		defer close(done)
+		defer func() {
+			if err := recover(); err != nil {
+				log.Println("Weixin handler panic:", err)
+			}
+		}()
+		handle(writer, r)
+	}()
+	timer := time.NewTimer(wx.replyTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		dw.expire()
+		log.Println("Weixin handler exceeded reply deadline:", r.MsgType, r.Event)
+	}
+}
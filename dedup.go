@@ -0,0 +1,63 @@
+package weixin
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// WithDedup process each message only once, weixin resend the message up to
+// three times if no reply in 5 seconds. The messages are identified by MsgId,
+// or FromUserName and CreateTime for events, and remembered in cache (in
+// memory if nil) for ttl. The duplicated message get the reply of the first
+// one, or "success" if the first one is still in process.
+func WithDedup(ttl time.Duration, cache Cache) Option {
+	return func(wx *Weixin) {
+		if cache == nil {
+			cache = NewMemoryCache()
+		}
+		wx.dedupTTL = ttl
+		wx.dedupCache = cache
+	}
+}
+
+// dedupKey return the key identify the message.
+func dedupKey(r *Request) string {
+	if r.MsgId != 0 {
+		return "weixin:msg:" + r.ToUserName + ":" + strconv.FormatInt(r.MsgId, 10)
+	}
+	return "weixin:msg:" + r.ToUserName + ":" + r.FromUserName + ":" + strconv.Itoa(r.CreateTime)
+}
+
+// dedupRequest route the message if it is not seen before, or reply the
+// remembered reply.
+func (wx *Weixin) dedupRequest(writer responseWriter, r *Request) {
+	key := dedupKey(r)
+	added, err := wx.dedupCache.Add(key, []byte{}, wx.dedupTTL)
+	if err != nil {
+		// Process the message anyway, handlers may see it again.
+		log.Println("Weixin check duplicated message failed:", err)
+		wx.routeRequest(writer, r)
+		return
+	}
+	if !added {
+		reply, _, err := wx.dedupCache.Get(key)
+		if err != nil {
+			log.Println("Weixin get reply of duplicated message failed:", err)
+		}
+		if len(reply) <= 0 || string(reply) == "success" {
+			writer.ReplyOK()
+		} else {
+			writer.replyMsg(string(reply))
+		}
+		return
+	}
+	var reply []byte
+	writer.record = &reply
+	wx.routeRequest(writer, r)
+	if len(reply) > 0 {
+		if err := wx.dedupCache.Set(key, reply, wx.dedupTTL); err != nil {
+			log.Println("Weixin remember reply of message failed:", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package weixin
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// ErrorClass is the class of weixin API error code.
+type ErrorClass int
+
+// nolint
+const (
+	ErrorClassUnknown ErrorClass = iota
+	ErrorClassRetryable
+	ErrorClassTokenInvalid
+	ErrorClassQuotaExceeded
+	ErrorClassUserBlocked
+	ErrorClassPermanent
+)
+
+// nolint
+const (
+	ErrCodeSystemBusy             = -1
+	ErrCodeInvalidCredential      = 40001
+	ErrCodeInvalidGrantType       = 40002
+	ErrCodeInvalidOpenId          = 40003
+	ErrCodeInvalidMediaType       = 40004
+	ErrCodeInvalidMediaId         = 40007
+	ErrCodeInvalidMessageType     = 40008
+	ErrCodeInvalidAppId           = 40013
+	ErrCodeInvalidAccessToken     = 40014
+	ErrCodeInvalidTemplateId      = 40037
+	ErrCodeInvalidAppSecret       = 40125
+	ErrCodeInvalidIP              = 40164
+	ErrCodeAccessTokenMissing     = 41001
+	ErrCodeAccessTokenExpired     = 42001
+	ErrCodeRequireSubscribe       = 43004
+	ErrCodeRequireRemoveBlacklist = 43019
+	ErrCodeUserRefuseMessage      = 43101
+	ErrCodeEmptyPostData          = 44002
+	ErrCodeDailyQuotaLimit        = 45009
+	ErrCodeMinuteQuotaLimit       = 45011
+	ErrCodeResponseOutOfTime      = 45015
+	ErrCodeCustomMessageLimit     = 45047
+	ErrCodeDataFormatError        = 47001
+	ErrCodeAPIUnauthorized        = 48001
+	ErrCodeAPIBlocked             = 48004
+	ErrCodeUserUnauthorized       = 50001
+)
+
+var errorClasses = map[int]ErrorClass{
+	ErrCodeSystemBusy:             ErrorClassRetryable,
+	ErrCodeInvalidCredential:      ErrorClassTokenInvalid,
+	ErrCodeInvalidAccessToken:     ErrorClassTokenInvalid,
+	ErrCodeAccessTokenExpired:     ErrorClassTokenInvalid,
+	ErrCodeDailyQuotaLimit:        ErrorClassQuotaExceeded,
+	ErrCodeMinuteQuotaLimit:       ErrorClassQuotaExceeded,
+	ErrCodeCustomMessageLimit:     ErrorClassQuotaExceeded,
+	ErrCodeRequireSubscribe:       ErrorClassUserBlocked,
+	ErrCodeRequireRemoveBlacklist: ErrorClassUserBlocked,
+	ErrCodeUserRefuseMessage:      ErrorClassUserBlocked,
+	ErrCodeResponseOutOfTime:      ErrorClassUserBlocked,
+	ErrCodeInvalidGrantType:       ErrorClassPermanent,
+	ErrCodeInvalidOpenId:          ErrorClassPermanent,
+	ErrCodeInvalidMediaType:       ErrorClassPermanent,
+	ErrCodeInvalidMediaId:         ErrorClassPermanent,
+	ErrCodeInvalidMessageType:     ErrorClassPermanent,
+	ErrCodeInvalidAppId:           ErrorClassPermanent,
+	ErrCodeInvalidTemplateId:      ErrorClassPermanent,
+	ErrCodeInvalidAppSecret:       ErrorClassPermanent,
+	ErrCodeInvalidIP:              ErrorClassPermanent,
+	ErrCodeAccessTokenMissing:     ErrorClassPermanent,
+	ErrCodeEmptyPostData:          ErrorClassPermanent,
+	ErrCodeDataFormatError:        ErrorClassPermanent,
+	ErrCodeAPIUnauthorized:        ErrorClassPermanent,
+	ErrCodeAPIBlocked:             ErrorClassPermanent,
+	ErrCodeUserUnauthorized:       ErrorClassPermanent,
+}
+
+var ridRegex = regexp.MustCompile(`rid:\s*([0-9A-Za-z-]+)`)
+
+// String return the name of error class.
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassRetryable:
+		return "retryable"
+	case ErrorClassTokenInvalid:
+		return "token-invalid"
+	case ErrorClassQuotaExceeded:
+		return "quota-exceeded"
+	case ErrorClassUserBlocked:
+		return "user-blocked"
+	case ErrorClassPermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+// ErrorClassOf return the class of weixin API error code.
+func ErrorClassOf(code int) ErrorClass {
+	if class, ok := errorClasses[code]; ok {
+		return class
+	}
+	return ErrorClassUnknown
+}
+
+// APIError is the error replied by weixin API.
+type APIError struct {
+	ErrCode  int
+	ErrMsg   string
+	Endpoint string
+	Rid      string
+}
+
+// endpointOf return the path of reqURL, never keep access token or secret
+// in error.
+func endpointOf(reqURL string) string {
+	if u, err := url.Parse(reqURL); err == nil {
+		return u.Path
+	}
+	return ""
+}
+
+// redactURLError remove the query of url from the transport error, which
+// carries the access token or secret.
+func redactURLError(err error, reqURL string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = endpointOf(reqURL)
+	}
+	return err
+}
+
+func newAPIError(reqURL string, code int, msg string) *APIError {
+	e := &APIError{ErrCode: code, ErrMsg: msg, Endpoint: endpointOf(reqURL)}
+	if m := ridRegex.FindStringSubmatch(msg); m != nil {
+		e.Rid = m[1]
+	}
+	return e
+}
+
+// Error return the error message.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("WeiXin request %s reply[%d]: %s", e.Endpoint, e.ErrCode, e.ErrMsg)
+}
+
+// Class return the class of error code.
+func (e *APIError) Class() ErrorClass {
+	return ErrorClassOf(e.ErrCode)
+}
+
+// IsRetryable check err is a weixin API error which can be retried.
+func IsRetryable(err error) bool {
+	return errorClassIs(err, ErrorClassRetryable)
+}
+
+// IsTokenInvalid check err is caused by invalid access token.
+func IsTokenInvalid(err error) bool {
+	return errorClassIs(err, ErrorClassTokenInvalid)
+}
+
+// IsQuotaExceeded check err is caused by API quota limit.
+func IsQuotaExceeded(err error) bool {
+	return errorClassIs(err, ErrorClassQuotaExceeded)
+}
+
+// IsUserBlocked check err is caused by user can not receive message.
+func IsUserBlocked(err error) bool {
+	return errorClassIs(err, ErrorClassUserBlocked)
+}
+
+// IsPermanent check err is a weixin API error which never succeed on retry.
+func IsPermanent(err error) bool {
+	return errorClassIs(err, ErrorClassPermanent)
+}
+
+func errorClassIs(err error, class ErrorClass) bool {
+	var e *APIError
+	return errors.As(err, &e) && e.Class() == class
+}
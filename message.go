@@ -0,0 +1,344 @@
+package weixin
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// Message is the typed message or event, such as *TextMessage or
+// *ClickEvent, returned by Request.Message.
+type Message interface {
+	Header() *MessageHeader
+}
+
+// Header return the message header.
+func (h *MessageHeader) Header() *MessageHeader {
+	return h
+}
+
+// TextMessage is the text message.
+type TextMessage struct {
+	MessageHeader
+	MsgId   int64 // nolint
+	Content string
+}
+
+// ImageMessage is the image message.
+type ImageMessage struct {
+	MessageHeader
+	MsgId   int64  // nolint
+	PicUrl  string // nolint
+	MediaId string // nolint
+}
+
+// VoiceMessage is the voice message, Recognition is the result of speech
+// recognition if enabled.
+type VoiceMessage struct {
+	MessageHeader
+	MsgId       int64  // nolint
+	MediaId     string // nolint
+	Format      string
+	Recognition string
+}
+
+// VideoMessage is the video message.
+type VideoMessage struct {
+	MessageHeader
+	MsgId        int64  // nolint
+	MediaId      string // nolint
+	ThumbMediaId string // nolint
+}
+
+// ShortVideoMessage is the short video message.
+type ShortVideoMessage struct {
+	MessageHeader
+	MsgId        int64  // nolint
+	MediaId      string // nolint
+	ThumbMediaId string // nolint
+}
+
+// LocationMessage is the location message.
+type LocationMessage struct {
+	MessageHeader
+	MsgId     int64   // nolint
+	LocationX float64 `xml:"Location_X"`
+	LocationY float64 `xml:"Location_Y"`
+	Scale     int
+	Label     string
+}
+
+// LinkMessage is the link message.
+type LinkMessage struct {
+	MessageHeader
+	MsgId       int64 // nolint
+	Title       string
+	Description string
+	Url         string // nolint
+}
+
+// SubscribeEvent is the subscribe event, EventKey and Ticket are set if
+// subscribe by scanning QR code.
+type SubscribeEvent struct {
+	MessageHeader
+	Event    string
+	EventKey string
+	Ticket   string
+}
+
+// UnsubscribeEvent is the unsubscribe event.
+type UnsubscribeEvent struct {
+	MessageHeader
+	Event string
+}
+
+// ScanEvent is the event of followers scanning QR code.
+type ScanEvent struct {
+	MessageHeader
+	Event    string
+	EventKey string
+	Ticket   string
+}
+
+// LocationEvent is the event of reporting location.
+type LocationEvent struct {
+	MessageHeader
+	Event     string
+	Latitude  float64
+	Longitude float64
+	Precision float64
+}
+
+// ClickEvent is the event of clicking menu button.
+type ClickEvent struct {
+	MessageHeader
+	Event    string
+	EventKey string
+}
+
+// ViewEvent is the event of clicking menu button to open url.
+type ViewEvent struct {
+	MessageHeader
+	Event    string
+	EventKey string
+	MenuId   int64 // nolint
+}
+
+// TemplateSentEvent is the result of sending template message.
+type TemplateSentEvent struct {
+	MessageHeader
+	Event  string
+	MsgId  int64 `xml:"MsgID"` // nolint
+	Status string
+}
+
+// ScancodeEvent is the event of scancode_push and scancode_waitmsg menu.
+type ScancodeEvent struct {
+	MessageHeader
+	Event        string
+	EventKey     string
+	ScanCodeInfo ScanCodeInfo
+}
+
+// PicEvent is the event of pic_sysphoto, pic_photo_or_album and pic_weixin
+// menu.
+type PicEvent struct {
+	MessageHeader
+	Event        string
+	EventKey     string
+	SendPicsInfo SendPicsInfo
+}
+
+// LocationSelectEvent is the event of location_select menu.
+type LocationSelectEvent struct {
+	MessageHeader
+	Event            string
+	EventKey         string
+	SendLocationInfo SendLocationInfo
+}
+
+// ViewMiniProgramEvent is the event of clicking menu button to open mini
+// program, EventKey is the page path.
+type ViewMiniProgramEvent struct {
+	MessageHeader
+	Event    string
+	EventKey string
+	MenuId   int64 // nolint
+}
+
+// MassSendJobFinishEvent is the result of mass send.
+type MassSendJobFinishEvent struct {
+	MessageHeader
+	Event                string
+	MsgId                int64 `xml:"MsgID"` // nolint
+	Status               string
+	TotalCount           int
+	FilterCount          int
+	SentCount            int
+	ErrorCount           int
+	CopyrightCheckResult CopyrightCheckResult
+}
+
+// KfSessionEvent is the event of creating, closing and switching customer
+// service session, FromKfAccount and ToKfAccount are set on switching.
+type KfSessionEvent struct {
+	MessageHeader
+	Event         string
+	KfAccount     string
+	FromKfAccount string
+	ToKfAccount   string
+}
+
+// UserGetCardEvent is the event of user getting card.
+type UserGetCardEvent struct {
+	MessageHeader
+	Event               string
+	CardId              string // nolint
+	IsGiveByFriend      int
+	UserCardCode        string
+	FriendUserName      string
+	OuterId             int // nolint
+	OldUserCardCode     string
+	OuterStr            string
+	IsRestoreMemberCard int
+	UnionId             string // nolint
+}
+
+// UserDelCardEvent is the event of user deleting card.
+type UserDelCardEvent struct {
+	MessageHeader
+	Event        string
+	CardId       string // nolint
+	UserCardCode string
+}
+
+// UserConsumeCardEvent is the event of card consumed.
+type UserConsumeCardEvent struct {
+	MessageHeader
+	Event         string
+	CardId        string // nolint
+	UserCardCode  string
+	ConsumeSource string
+	LocationName  string
+	StaffOpenId   string // nolint
+	VerifyCode    string
+	RemarkAmount  string
+	OuterStr      string
+}
+
+// newMessage return the typed message of msgType and event, or nil.
+func newMessage(msgType string, event string) Message {
+	switch msgType {
+	case MsgTypeText:
+		return &TextMessage{}
+	case MsgTypeImage:
+		return &ImageMessage{}
+	case MsgTypeVoice:
+		return &VoiceMessage{}
+	case MsgTypeVideo:
+		return &VideoMessage{}
+	case MsgTypeShortVideo:
+		return &ShortVideoMessage{}
+	case MsgTypeLocation:
+		return &LocationMessage{}
+	case MsgTypeLink:
+		return &LinkMessage{}
+	case msgEvent:
+		switch event {
+		case EventSubscribe:
+			return &SubscribeEvent{}
+		case EventUnsubscribe:
+			return &UnsubscribeEvent{}
+		case EventScan:
+			return &ScanEvent{}
+		case EventLocation:
+			return &LocationEvent{}
+		case EventClick:
+			return &ClickEvent{}
+		case EventView:
+			return &ViewEvent{}
+		case EventTemplateSent:
+			return &TemplateSentEvent{}
+		case EventScancodePush, EventScancodeWaitmsg:
+			return &ScancodeEvent{}
+		case EventPicSysphoto, EventPicPhotoOrAlbum, EventPicWeixin:
+			return &PicEvent{}
+		case EventLocationSelect:
+			return &LocationSelectEvent{}
+		case EventViewMiniProgram:
+			return &ViewMiniProgramEvent{}
+		case EventMassSendJobFinish:
+			return &MassSendJobFinishEvent{}
+		case EventKfCreateSession, EventKfCloseSession, EventKfSwitchSession:
+			return &KfSessionEvent{}
+		case EventUserGetCard:
+			return &UserGetCardEvent{}
+		case EventUserDelCard:
+			return &UserDelCardEvent{}
+		case EventUserConsumeCard:
+			return &UserConsumeCardEvent{}
+		}
+	}
+	return nil
+}
+
+// Message return the typed message parsed from the request xml, use type
+// switch to get the message. The request itself is returned if the message
+// type is unknown or the xml can not be parsed.
+func (r *Request) Message() Message {
+	msg := newMessage(r.MsgType, r.Event)
+	if msg == nil || len(r.Raw) <= 0 {
+		return r
+	}
+	if err := xml.Unmarshal(r.Raw, msg); err != nil {
+		return r
+	}
+	return msg
+}
+
+// parseFields return the text of top level elements in xml, or the inner xml
+// of elements with children.
+func parseFields(data []byte) (map[string]string, error) {
+	fields := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	name := ""
+	var text []byte
+	start := int64(0)
+	nested := false
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return fields, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				name = t.Name.Local
+				text = text[:0]
+				start = decoder.InputOffset()
+				nested = false
+			} else if depth > 2 {
+				nested = true
+			}
+		case xml.CharData:
+			if depth == 2 {
+				text = append(text, t...)
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				if nested {
+					fields[name] = string(data[start:offset])
+				} else {
+					fields[name] = string(text)
+				}
+			}
+			depth--
+		}
+	}
+}
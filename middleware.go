@@ -0,0 +1,70 @@
+package weixin
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// Middleware wrap HandlerFunc to add logic around handlers, such as logging,
+// metrics and recovery.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Group is a group of handlers sharing middlewares.
+type Group struct {
+	wx          *Weixin
+	middlewares []Middleware
+}
+
+// chain wrap handler with middlewares, the first middleware is the outermost.
+func chain(middlewares []Middleware, handler HandlerFunc) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use add middlewares applied to all handlers, the middlewares run in the
+// order they are added.
+func (wx *Weixin) Use(middlewares ...Middleware) {
+	wx.middlewares = append(wx.middlewares, middlewares...)
+}
+
+// Group create a group of handlers, the middlewares are applied to the
+// handlers registered by the group only, inside the middlewares of Weixin.
+func (wx *Weixin) Group(middlewares ...Middleware) *Group {
+	return &Group{wx: wx, middlewares: middlewares}
+}
+
+// Use add middlewares applied to the handlers of group.
+func (g *Group) Use(middlewares ...Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// HandleFunc register request callback with the middlewares of group.
+func (g *Group) HandleFunc(pattern string, handler HandlerFunc) {
+	g.wx.HandleFunc(pattern, g.wrap(handler))
+}
+
+// wrap apply the middlewares of group to handler when it is called, so the
+// middlewares added later are applied too.
+func (g *Group) wrap(handler HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		chain(g.middlewares, handler)(w, r)
+	}
+}
+
+// Recovery create a middleware recover the panic in handler, the panic is
+// logged and "success" is replied.
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("Weixin handler panic: %v\n%s", err, debug.Stack())
+					w.ReplyOK()
+				}
+			}()
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package weixin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy define how the failed requests to weixin API are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles on each retry.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound of delay.
+	MaxDelay time.Duration
+	// Jitter is the random fraction (0~1) subtracted from each delay.
+	Jitter float64
+	// RetryableCodes is the error codes can be retried.
+	RetryableCodes []int
+	// RetryNonIdempotent retry non-idempotent requests (such as sending
+	// messages) on network errors and 5xx replies, the request may be
+	// processed by weixin already and duplicated.
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy is the retry policy used by default.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	BaseDelay:      200 * time.Millisecond,
+	MaxDelay:       2 * time.Second,
+	Jitter:         0.5,
+	RetryableCodes: []int{ErrCodeSystemBusy},
+}
+
+// WithRetryPolicy set the retry policy of requests to weixin API.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(wx *Weixin) {
+		wx.retryPolicy = policy
+	}
+}
+
+// httpStatusError is returned when weixin API reply non 2xx status.
+type httpStatusError struct {
+	StatusCode int
+	Endpoint   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("WeiXin request %s reply status %d", e.Endpoint, e.StatusCode)
+}
+
+func (p *RetryPolicy) retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrClosed) || errors.Is(err, errNoAppSecret) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// Weixin rejected the request, it is safe to send again.
+		for _, code := range p.RetryableCodes {
+			if code == apiErr.ErrCode {
+				return true
+			}
+		}
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// The request is never sent.
+		return true
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+		return false
+	}
+	// Network errors and 5xx replies, the request may be processed.
+	return idempotent || p.RetryNonIdempotent
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		if d > math.MaxInt64/2 {
+			d = math.MaxInt64
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// retry call do until it succeed or the policy stop retrying.
+func (wx *Weixin) retry(ctx context.Context, idempotent bool, do func() error) error {
+	policy := &wx.retryPolicy
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err, idempotent) {
+			return err
+		}
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
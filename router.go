@@ -0,0 +1,227 @@
+package weixin
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// Prefix of event key in subscribe event by scanning QR code
+	qrScenePrefix = "qrscene_"
+)
+
+// Route is the conditions to match requests, the empty conditions match
+// any request.
+type Route struct {
+	// MsgType is the message type, such as MsgTypeText or "event", it is
+	// "event" if Event or Scene is set. The patterns MsgTypeDefault,
+	// MsgTypeEvent and MsgTypeEvent* are converted to the plain values,
+	// other patterns are not supported.
+	MsgType string
+	// Event is the event type, such as EventClick.
+	Event string
+	// EventKey is the key of event.
+	EventKey string
+	// Scene is the QR scene of subscribe and SCAN events, the "qrscene_"
+	// prefix of subscribe event is stripped.
+	Scene string
+	// Content is the content of text message.
+	Content string
+	// Match is the custom condition.
+	Match func(*Request) bool
+	// Priority of the route, the routes of higher priority are matched
+	// first, the routes of same priority are matched in registered order.
+	Priority int
+}
+
+type route struct {
+	regex   *regexp.Regexp // pattern of HandleFunc
+	cond    Route
+	handler HandlerFunc
+	seq     int
+}
+
+// Scene return the QR scene of subscribe and SCAN events, or empty string.
+func (r *Request) Scene() string {
+	if r.MsgType != msgEvent {
+		return ""
+	}
+	switch r.Event {
+	case EventSubscribe:
+		if strings.HasPrefix(r.EventKey, qrScenePrefix) {
+			return r.EventKey[len(qrScenePrefix):]
+		}
+	case EventScan:
+		return r.EventKey
+	}
+	return ""
+}
+
+// requestPath return the path matched by the patterns of HandleFunc.
+func requestPath(r *Request) string {
+	if r.MsgType == msgEvent {
+		return r.MsgType + "." + r.Event
+	}
+	return r.MsgType
+}
+
+// routeKey return the key of routes for exact matching.
+func routeKey(msgType string, event string) string {
+	if msgType == msgEvent {
+		return msgType + "." + event
+	}
+	return msgType
+}
+
+func (rt *route) match(path string, r *Request) bool {
+	if rt.regex != nil {
+		return rt.regex.MatchString(path)
+	}
+	c := &rt.cond
+	return (len(c.MsgType) <= 0 || c.MsgType == r.MsgType) &&
+		(len(c.Event) <= 0 || c.Event == r.Event) &&
+		(len(c.EventKey) <= 0 || c.EventKey == r.EventKey) &&
+		(len(c.Scene) <= 0 || c.Scene == r.Scene()) &&
+		(len(c.Content) <= 0 || c.Content == r.Content) &&
+		(c.Match == nil || c.Match(r))
+}
+
+// before return true if rt is matched before other.
+func (rt *route) before(other *route) bool {
+	if rt.cond.Priority != other.cond.Priority {
+		return rt.cond.Priority > other.cond.Priority
+	}
+	return rt.seq < other.seq
+}
+
+// insertRoute insert rt into routes in matching order.
+func insertRoute(routes []*route, rt *route) []*route {
+	i := len(routes)
+	for i > 0 && rt.before(routes[i-1]) {
+		i--
+	}
+	routes = append(routes, nil)
+	copy(routes[i+1:], routes[i:])
+	routes[i] = rt
+	return routes
+}
+
+// normalizeRoute convert the MsgType patterns of HandleFunc to plain values,
+// panic if MsgType is other pattern.
+func normalizeRoute(c *Route) {
+	switch {
+	case c.MsgType == MsgTypeDefault:
+		c.MsgType = ""
+	case c.MsgType == MsgTypeEvent:
+		c.MsgType = msgEvent
+	case strings.HasPrefix(c.MsgType, msgEvent+"\\."):
+		event := c.MsgType[len(msgEvent+"\\."):]
+		if regexp.QuoteMeta(event) != event || (len(c.Event) > 0 && c.Event != event) {
+			panic("weixin: unsupported MsgType of Route: " + c.MsgType)
+		}
+		c.MsgType = msgEvent
+		c.Event = event
+	}
+	if regexp.QuoteMeta(c.MsgType) != c.MsgType {
+		panic("weixin: unsupported MsgType of Route: " + c.MsgType)
+	}
+}
+
+func (wx *Weixin) addRoute(rt *route) {
+	wx.routeSeq++
+	rt.seq = wx.routeSeq
+	c := &rt.cond
+	if rt.regex == nil {
+		normalizeRoute(c)
+	}
+	if rt.regex == nil && (len(c.Event) > 0 || len(c.Scene) > 0) {
+		c.MsgType = msgEvent
+	}
+	var keys []string
+	switch {
+	case rt.regex != nil || len(c.MsgType) <= 0:
+	case len(c.Event) > 0:
+		keys = []string{routeKey(c.MsgType, c.Event)}
+	case len(c.Scene) > 0:
+		keys = []string{routeKey(msgEvent, EventSubscribe), routeKey(msgEvent, EventScan)}
+	case c.MsgType != msgEvent:
+		keys = []string{c.MsgType}
+	}
+	if len(keys) <= 0 {
+		wx.routes = insertRoute(wx.routes, rt)
+		return
+	}
+	if wx.exactRoutes == nil {
+		wx.exactRoutes = make(map[string][]*route)
+	}
+	for _, key := range keys {
+		wx.exactRoutes[key] = insertRoute(wx.exactRoutes[key], rt)
+	}
+}
+
+// Handle register request callback matched by route.
+func (wx *Weixin) Handle(cond Route, handler HandlerFunc) {
+	wx.addRoute(&route{cond: cond, handler: handler})
+}
+
+// HandleClick register callback of menu CLICK event with key.
+func (wx *Weixin) HandleClick(key string, handler HandlerFunc) {
+	wx.Handle(Route{Event: EventClick, EventKey: key}, handler)
+}
+
+// HandleView register callback of menu VIEW event with url.
+func (wx *Weixin) HandleView(url string, handler HandlerFunc) {
+	wx.Handle(Route{Event: EventView, EventKey: url}, handler)
+}
+
+// HandleScene register callback of QR scene, both subscribe event of new
+// followers scanning the QR code and SCAN event of followers are handled.
+func (wx *Weixin) HandleScene(scene string, handler HandlerFunc) {
+	wx.Handle(Route{Scene: scene}, handler)
+}
+
+// Handle register request callback matched by route with the middlewares
+// of group.
+func (g *Group) Handle(cond Route, handler HandlerFunc) {
+	g.wx.Handle(cond, g.wrap(handler))
+}
+
+// HandleNotFound set the handler of requests matched by no route, "success"
+// is replied by default.
+func (wx *Weixin) HandleNotFound(handler HandlerFunc) {
+	wx.notFound = handler
+}
+
+// WithNotFoundHook set the hook called with the requests matched by no
+// route, such as to log or count them, the requests are logged by default.
+func WithNotFoundHook(hook func(*Request)) Option {
+	return func(wx *Weixin) {
+		wx.notFoundHook = hook
+	}
+}
+
+// TextHandler create a handler reply text, such as the reply of requests
+// matched by no route.
+func TextHandler(text string) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		w.ReplyText(text)
+	}
+}
+
+// matchRoute return the first matched route in order of priority.
+func (wx *Weixin) matchRoute(r *Request) *route {
+	path := requestPath(r)
+	var found *route
+	for _, routes := range [][]*route{wx.exactRoutes[routeKey(r.MsgType, r.Event)], wx.routes} {
+		for _, rt := range routes {
+			if found != nil && found.before(rt) {
+				break
+			}
+			if rt.match(path, r) {
+				found = rt
+				break
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,170 @@
+package weixin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TokenStore is used to share access token between Weixin instances.
+// Only the instance which holds the lock of appid refresh the token,
+// the others wait and read the token from the store.
+type TokenStore interface {
+	// Load return the stored access token of appid, an empty token if not found.
+	Load(appid string) (AccessToken, error)
+	// Store save the access token of appid.
+	Store(appid string, token AccessToken) error
+	// Lock try to acquire the refresh lock of appid, the lock is released
+	// automatically after ttl in case of the holder crashed.
+	Lock(appid string, ttl time.Duration) (bool, error)
+	// Unlock release the refresh lock of appid.
+	Unlock(appid string) error
+}
+
+type memoryTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]AccessToken
+	locks  map[string]time.Time
+}
+
+// NewMemoryTokenStore create a token store in memory, it can be shared by
+// Weixin instances in the same process.
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{
+		tokens: make(map[string]AccessToken),
+		locks:  make(map[string]time.Time),
+	}
+}
+
+func (s *memoryTokenStore) Load(appid string) (AccessToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokens[appid], nil
+}
+
+func (s *memoryTokenStore) Store(appid string, token AccessToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[appid] = token
+	return nil
+}
+
+func (s *memoryTokenStore) Lock(appid string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if expires, ok := s.locks[appid]; ok && time.Now().Before(expires) {
+		return false, nil
+	}
+	s.locks[appid] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *memoryTokenStore) Unlock(appid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.locks, appid)
+	return nil
+}
+
+type fileTokenStore struct {
+	dir string
+}
+
+// NewFileTokenStore create a token store saved in dir, it can be shared by
+// processes on the same host.
+func NewFileTokenStore(dir string) (TokenStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileTokenStore{dir}, nil
+}
+
+func (s *fileTokenStore) Load(appid string) (AccessToken, error) {
+	var token AccessToken
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, appid+".token"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return token, nil
+		}
+		return token, err
+	}
+	err = json.Unmarshal(data, &token)
+	return token, err
+}
+
+func (s *fileTokenStore) Store(appid string, token AccessToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so readers never see a partial file.
+	file, err := ioutil.TempFile(s.dir, appid+".token.")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()           // nolint
+		os.Remove(file.Name()) // nolint
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name()) // nolint
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(s.dir, appid+".token"))
+}
+
+func (s *fileTokenStore) Lock(appid string, ttl time.Duration) (bool, error) {
+	name := filepath.Join(s.dir, appid+".lock")
+	for i := 0; i < 2; i++ {
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return true, file.Close()
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		// Remove the lock left by a crashed holder.
+		info, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		if time.Since(info.ModTime()) < ttl {
+			return false, nil
+		}
+		// The lock may be replaced by a fresh one after stat, so move it to
+		// a unique name first (only one process can move it) and check again.
+		stale := name + "." + randomString(8) + ".stale"
+		if err := os.Rename(name, stale); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		info, err = os.Stat(stale)
+		if err == nil && time.Since(info.ModTime()) < ttl {
+			// Put back the fresh lock, it fails if another one is created.
+			os.Link(stale, name) // nolint
+			os.Remove(stale)     // nolint
+			return false, nil
+		}
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (s *fileTokenStore) Unlock(appid string) error {
+	err := os.Remove(filepath.Join(s.dir, appid+".lock"))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
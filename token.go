@@ -0,0 +1,110 @@
+package weixin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Refresh the token in background before it expires.
+	tokenEarlyRefresh = 5 * time.Minute
+)
+
+type cachedToken struct {
+	token     AccessToken
+	refreshAt time.Time
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token AccessToken
+	err   error
+}
+
+// tokenCache hold the token for lock-free reading, the concurrent callers
+// share one fetch when the token need to be refreshed.
+type tokenCache struct {
+	current atomic.Value // *cachedToken
+	mutex   sync.Mutex
+	call    *tokenCall
+	fetch   func(stale string, force bool) (AccessToken, error)
+	done    <-chan struct{}
+}
+
+func newTokenCache(fetch func(stale string, force bool) (AccessToken, error), done <-chan struct{}) *tokenCache {
+	c := &tokenCache{fetch: fetch, done: done}
+	c.current.Store(&cachedToken{})
+	return c
+}
+
+func (c *tokenCache) load() *cachedToken {
+	return c.current.Load().(*cachedToken)
+}
+
+// get return the valid token, fetch one if there is none.
+func (c *tokenCache) get(ctx context.Context) (AccessToken, error) {
+	cached := c.load()
+	now := time.Now()
+	if len(cached.token.Token) > 0 && now.Before(cached.token.Expires) {
+		if now.After(cached.refreshAt) {
+			c.refresh(cached.token.Token, false)
+		}
+		return cached.token, nil
+	}
+	return c.wait(ctx, c.refresh(cached.token.Token, false))
+}
+
+// invalidate fetch a new token if the current one is still stale, fetch
+// anyway if stale is empty.
+func (c *tokenCache) invalidate(ctx context.Context, stale string) (AccessToken, error) {
+	if len(stale) <= 0 {
+		stale = c.load().token.Token
+	}
+	return c.wait(ctx, c.refresh(stale, true))
+}
+
+// refresh start fetching the token unless it is refreshed already, force
+// means the stale token is known to be invalid rather than expiring.
+func (c *tokenCache) refresh(stale string, force bool) *tokenCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.call != nil {
+		return c.call
+	}
+	if cached := c.load(); cached.token.Token != stale && time.Now().Before(cached.token.Expires) {
+		call := &tokenCall{done: make(chan struct{}), token: cached.token}
+		close(call.done)
+		return call
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	c.call = call
+	go func() {
+		call.token, call.err = c.fetch(stale, force)
+		if call.err == nil {
+			lifetime := time.Until(call.token.Expires)
+			early := tokenEarlyRefresh
+			if early > lifetime/10 {
+				early = lifetime / 10
+			}
+			c.current.Store(&cachedToken{call.token, call.token.Expires.Add(-early)})
+		}
+		c.mutex.Lock()
+		c.call = nil
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+func (c *tokenCache) wait(ctx context.Context, call *tokenCall) (AccessToken, error) {
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return AccessToken{}, ctx.Err()
+	case <-c.done:
+		return AccessToken{}, ErrClosed
+	}
+}
@@ -0,0 +1,101 @@
+package weixin
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubFetch return tokens "token-1", "token-2", ... and count the calls.
+func stubFetch(calls *int32, delay time.Duration) func(string, bool) (AccessToken, error) {
+	return func(stale string, force bool) (AccessToken, error) {
+		n := atomic.AddInt32(calls, 1)
+		time.Sleep(delay)
+		return AccessToken{"token-" + strconv.Itoa(int(n)), time.Now().Add(2 * time.Hour)}, nil
+	}
+}
+
+func TestTokenCacheConcurrentGet(t *testing.T) {
+	var calls int32
+	c := newTokenCache(stubFetch(&calls, 20*time.Millisecond), make(chan struct{}))
+	var wg sync.WaitGroup
+	tokens := make([]string, 100)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := c.get(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			tokens[i] = token.Token
+		}(i)
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("fetch called %d times, want 1", calls)
+	}
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Fatalf("got token %q, want token-1", token)
+		}
+	}
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	var calls int32
+	c := newTokenCache(stubFetch(&calls, 0), make(chan struct{}))
+	ctx := context.Background()
+	if _, err := c.get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The stale token is replaced already.
+	token, err := c.invalidate(ctx, "token-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "token-1" || calls != 1 {
+		t.Fatalf("got %q after %d fetches, want token-1 after 1", token.Token, calls)
+	}
+	// The current token is stale.
+	token, err = c.invalidate(ctx, "token-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "token-2" || calls != 2 {
+		t.Fatalf("got %q after %d fetches, want token-2 after 2", token.Token, calls)
+	}
+}
+
+func TestTokenCacheClosed(t *testing.T) {
+	wx := New("token", "appid", "secret")
+	release := make(chan struct{})
+	defer close(release)
+	wx.accessToken = newTokenCache(func(stale string, force bool) (AccessToken, error) {
+		<-release
+		return AccessToken{}, errNoAccessToken
+	}, wx.done)
+	wx.Close() // nolint
+	if _, err := wx.accessToken.get(context.Background()); err != ErrClosed {
+		t.Fatalf("got error %v, want ErrClosed", err)
+	}
+}
+
+func BenchmarkGetAccessTokenParallel(b *testing.B) {
+	var calls int32
+	wx := New("token", "appid", "secret")
+	defer wx.Close() // nolint
+	wx.accessToken = newTokenCache(stubFetch(&calls, 0), wx.done)
+	wx.GetAccessToken()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if len(wx.GetAccessToken().Token) <= 0 {
+				b.Fatal("empty token")
+			}
+		}
+	})
+}
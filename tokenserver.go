@@ -0,0 +1,156 @@
+package weixin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Token server request type
+	tokenServerTypeAccessToken = "access_token"
+	tokenServerTypeJsAPITicket = "jsapi_ticket"
+	// Max time a client keeps the token before pulling again,
+	// so that a refresh on the server reaches all clients soon.
+	tokenServerCacheTTL = time.Minute
+)
+
+type tokenServerReply struct {
+	response
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+type tokenClient struct {
+	url        string
+	key        string
+	httpClient *http.Client
+}
+
+// WithTokenServer make the instance a client of the central token server,
+// the access token and js api ticket are pulled from serverURL which is
+// served by TokenHandler of another instance.
+func WithTokenServer(serverURL string, key string) Option {
+	return func(wx *Weixin) {
+		wx.tokenClient = &tokenClient{serverURL, key, http.DefaultClient}
+	}
+}
+
+// TokenHandler return the handler of central token server, it provides the
+// access token and js api ticket of wx to the instances created with
+// WithTokenServer, requests must carry the key in Authorization header.
+func (wx *Weixin) TokenHandler(key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(key) <= 0 || subtle.ConstantTimeCompare([]byte(auth), []byte(key)) != 1 {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		var reply tokenServerReply
+		switch r.FormValue("type") {
+		case tokenServerTypeAccessToken, "":
+			token := wx.GetAccessTokenContext(r.Context())
+			// Refresh only when the client holds the current token,
+			// so that clients with the same stale token refresh once.
+			if r.FormValue("refresh") == "1" && token.Token == r.FormValue("stale") {
+				wx.RefreshAccessTokenContext(r.Context())
+				token = wx.GetAccessTokenContext(r.Context())
+			}
+			reply.Token = token.Token
+			reply.ExpiresAt = token.Expires.Unix()
+		case tokenServerTypeJsAPITicket:
+			ticket, err := wx.getJsAPITicketWithExpires(r.Context())
+			if err != nil {
+				log.Println("Token server get js api ticket failed: ", err)
+				http.Error(w, "", http.StatusServiceUnavailable)
+				return
+			}
+			reply.Token = ticket.ticket
+			reply.ExpiresAt = ticket.expires.Unix()
+		default:
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if len(reply.Token) <= 0 {
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(data) // nolint
+	})
+}
+
+func (c *tokenClient) fetch(tokenType string, refresh bool, stale string) (string, time.Time, error) {
+	params := url.Values{}
+	params.Set("type", tokenType)
+	if refresh {
+		params.Set("refresh", "1")
+		params.Set("stale", stale)
+	}
+	sep := "?"
+	if strings.Contains(c.url, "?") {
+		sep = "&"
+	}
+	reqURL := c.url + sep + params.Encode()
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return "", time.Time{}, redactURLError(err, reqURL)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.key)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	r, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", time.Time{}, redactURLError(err, reqURL)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("WeiXin token server reply status %d", r.StatusCode)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var reply tokenServerReply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return "", time.Time{}, err
+	}
+	if len(reply.Token) <= 0 {
+		return "", time.Time{}, errors.New("WeiXin token server reply empty token")
+	}
+	expires := time.Unix(reply.ExpiresAt, 0)
+	if limit := time.Now().Add(tokenServerCacheTTL); expires.After(limit) {
+		expires = limit
+	}
+	return reply.Token, expires, nil
+}
+
+func (c *tokenClient) accessToken(refresh bool, stale string) AccessToken {
+	token, expires, err := c.fetch(tokenServerTypeAccessToken, refresh, stale)
+	if err != nil {
+		log.Println("Get access token from token server failed: ", err)
+		return AccessToken{"", time.Now()}
+	}
+	return AccessToken{token, expires}
+}
+
+func (c *tokenClient) jsAPITicket() (*jsAPITicket, error) {
+	ticket, expires, err := c.fetch(tokenServerTypeJsAPITicket, false, "")
+	if err != nil {
+		return nil, err
+	}
+	return &jsAPITicket{ticket, expires}, nil
+}
@@ -3,11 +3,9 @@ package weixin
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
 	"crypto/sha1"
-	"encoding/base64"
-	"encoding/binary"
+	"crypto/subtle"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -21,9 +19,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 )
 
@@ -40,6 +38,24 @@ const (
 	EventLocation     = "LOCATION"
 	EventTemplateSent = "TEMPLATESENDJOBFINISH"
 
+	// Menu event type
+	EventScancodePush    = "scancode_push"
+	EventScancodeWaitmsg = "scancode_waitmsg"
+	EventPicSysphoto     = "pic_sysphoto"
+	EventPicPhotoOrAlbum = "pic_photo_or_album"
+	EventPicWeixin       = "pic_weixin"
+	EventLocationSelect  = "location_select"
+	EventViewMiniProgram = "view_miniprogram"
+
+	// Mass send, customer service and card event type
+	EventMassSendJobFinish = "MASSSENDJOBFINISH"
+	EventKfCreateSession   = "kf_create_session"
+	EventKfCloseSession    = "kf_close_session"
+	EventKfSwitchSession   = "kf_switch_session"
+	EventUserGetCard       = "user_get_card"
+	EventUserDelCard       = "user_del_card"
+	EventUserConsumeCard   = "user_consume_card"
+
 	// Message type
 	MsgTypeDefault           = ".*"
 	MsgTypeText              = "text"
@@ -58,6 +74,24 @@ const (
 	MsgTypeEventLocation     = msgEvent + "\\." + EventLocation
 	MsgTypeEventTemplateSent = msgEvent + "\\." + EventTemplateSent
 
+	// Menu event message type
+	MsgTypeEventScancodePush    = msgEvent + "\\." + EventScancodePush
+	MsgTypeEventScancodeWaitmsg = msgEvent + "\\." + EventScancodeWaitmsg
+	MsgTypeEventPicSysphoto     = msgEvent + "\\." + EventPicSysphoto
+	MsgTypeEventPicPhotoOrAlbum = msgEvent + "\\." + EventPicPhotoOrAlbum
+	MsgTypeEventPicWeixin       = msgEvent + "\\." + EventPicWeixin
+	MsgTypeEventLocationSelect  = msgEvent + "\\." + EventLocationSelect
+	MsgTypeEventViewMiniProgram = msgEvent + "\\." + EventViewMiniProgram
+
+	// Mass send, customer service and card event message type
+	MsgTypeEventMassSendJobFinish = msgEvent + "\\." + EventMassSendJobFinish
+	MsgTypeEventKfCreateSession   = msgEvent + "\\." + EventKfCreateSession
+	MsgTypeEventKfCloseSession    = msgEvent + "\\." + EventKfCloseSession
+	MsgTypeEventKfSwitchSession   = msgEvent + "\\." + EventKfSwitchSession
+	MsgTypeEventUserGetCard       = msgEvent + "\\." + EventUserGetCard
+	MsgTypeEventUserDelCard       = msgEvent + "\\." + EventUserDelCard
+	MsgTypeEventUserConsumeCard   = msgEvent + "\\." + EventUserConsumeCard
+
 	// Media type
 	MediaTypeImage = "image"
 	MediaTypeVoice = "voice"
@@ -82,20 +116,33 @@ const (
 	// Redirect Scope
 	RedirectURLScopeBasic    = "snsapi_base"
 	RedirectURLScopeUserInfo = "snsapi_userinfo"
-	// Weixin host URL
-	weixinHost               = "https://api.weixin.qq.com/cgi-bin"
-	weixinQRScene            = "https://api.weixin.qq.com/cgi-bin/qrcode"
+	// Weixin API host
+	APIHostDefault  = "https://api.weixin.qq.com"
+	APIHostBackup   = "https://api2.weixin.qq.com"
+	APIHostShanghai = "https://sh.api.weixin.qq.com"
+	APIHostShenzhen = "https://sz.api.weixin.qq.com"
+	APIHostHongKong = "https://hk.api.weixin.qq.com"
+	FileHostDefault = "http://file.api.weixin.qq.com"
+	// Weixin API path
+	weixinCgiBin             = "/cgi-bin"
+	weixinQRScene            = "/cgi-bin/qrcode"
 	weixinShowQRScene        = "https://mp.weixin.qq.com/cgi-bin/showqrcode"
-	weixinMaterialURL        = "https://api.weixin.qq.com/cgi-bin/material"
-	weixinShortURL           = "https://api.weixin.qq.com/cgi-bin/shorturl"
-	weixinUserInfo           = "https://api.weixin.qq.com/cgi-bin/user/info"
-	weixinFileURL            = "http://file.api.weixin.qq.com/cgi-bin/media"
-	weixinTemplate           = "https://api.weixin.qq.com/cgi-bin/template"
+	weixinMaterialURL        = "/cgi-bin/material"
+	weixinShortURL           = "/cgi-bin/shorturl"
+	weixinUserInfo           = "/cgi-bin/user/info"
+	weixinFileURL            = "/cgi-bin/media"
+	weixinTemplate           = "/cgi-bin/template"
 	weixinRedirectURL        = "https://open.weixin.qq.com/connect/oauth2/authorize?appid=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s#wechat_redirect"
-	weixinUserAccessTokenURL = "https://api.weixin.qq.com/sns/oauth2/access_token?appid=%s&secret=%s&code=%s&grant_type=authorization_code"
-	weixinJsApiTicketURL     = "https://api.weixin.qq.com/cgi-bin/ticket/getticket"
+	weixinUserAccessTokenURL = "/sns/oauth2/access_token?appid=%s&secret=%s&code=%s&grant_type=authorization_code"
+	weixinJsApiTicketURL     = "/cgi-bin/ticket/getticket"
 	// Max retry count
 	retryMaxN = 3
+	// Timeout of requests in background
+	requestTimeout = 30 * time.Second
+	// Access token refresh lock
+	tokenLockTTL   = 30 * time.Second
+	tokenLockWait  = 200 * time.Millisecond
+	tokenLockRetry = 50
 	// Reply format
 	replyText               = "<xml>%s<MsgType><![CDATA[text]]></MsgType><Content><![CDATA[%s]]></Content></xml>"
 	replyImage              = "<xml>%s<MsgType><![CDATA[image]]></MsgType><Image><MediaId><![CDATA[%s]]></MediaId></Image></xml>"
@@ -106,6 +153,7 @@ const (
 	replyHeader             = "<ToUserName><![CDATA[%s]]></ToUserName><FromUserName><![CDATA[%s]]></FromUserName><CreateTime>%d</CreateTime>"
 	replyArticle            = "<item><Title><![CDATA[%s]]></Title> <Description><![CDATA[%s]]></Description><PicUrl><![CDATA[%s]]></PicUrl><Url><![CDATA[%s]]></Url></item>"
 	transferCustomerService = "<xml>" + replyHeader + "<MsgType><![CDATA[transfer_customer_service]]></MsgType></xml>"
+	replyEncrypt            = "<xml><Encrypt><![CDATA[%s]]></Encrypt><MsgSignature><![CDATA[%s]]></MsgSignature><TimeStamp>%s</TimeStamp><Nonce><![CDATA[%s]]></Nonce></xml>"
 
 	// Material request
 	requestMaterial = `{"type":"%s","offset":%d,"count":%d}`
@@ -149,6 +197,92 @@ type Request struct {
 	Precision    float32
 	Recognition  string
 	Status       string
+
+	// Menu events
+	MenuId           int64 // nolint
+	ScanCodeInfo     ScanCodeInfo
+	SendPicsInfo     SendPicsInfo
+	SendLocationInfo SendLocationInfo
+
+	// Mass send events, JobMsgId is the id of mass send and template message
+	JobMsgId             int64 `xml:"MsgID"` // nolint
+	TotalCount           int
+	FilterCount          int
+	SentCount            int
+	ErrorCount           int
+	CopyrightCheckResult CopyrightCheckResult
+
+	// Customer service events
+	KfAccount     string
+	FromKfAccount string
+	ToKfAccount   string
+
+	// Card events
+	CardId              string // nolint
+	UserCardCode        string
+	IsGiveByFriend      int
+	FriendUserName      string
+	OuterId             int // nolint
+	OldUserCardCode     string
+	OuterStr            string
+	IsRestoreMemberCard int
+	UnionId             string // nolint
+	ConsumeSource       string
+	LocationName        string
+	StaffOpenId         string // nolint
+	VerifyCode          string
+	RemarkAmount        string
+
+	// Raw is the xml of message (decrypted in safe mode), Fields is the text
+	// of top level elements, or the inner xml of elements with children.
+	Raw    []byte            `xml:"-"`
+	Fields map[string]string `xml:"-"`
+}
+
+// CopyrightCheckResult is the result of copyright check of mass send.
+type CopyrightCheckResult struct {
+	Count      int
+	ResultList []CopyrightCheckItem `xml:"ResultList>item"`
+	CheckState int
+}
+
+// CopyrightCheckItem is the copyright check result of article.
+type CopyrightCheckItem struct {
+	ArticleIdx            int
+	UserDeclareState      int
+	AuditState            int
+	OriginalArticleUrl    string // nolint
+	OriginalArticleType   int
+	CanReprint            int
+	NeedReplaceContent    int
+	NeedShowReprintSource int
+}
+
+// ScanCodeInfo is the result of scancode_push and scancode_waitmsg events.
+type ScanCodeInfo struct {
+	ScanType   string
+	ScanResult string
+}
+
+// SendPicsInfo is the pictures of pic_sysphoto, pic_photo_or_album and
+// pic_weixin events.
+type SendPicsInfo struct {
+	Count   int
+	PicList []SendPicItem `xml:"PicList>item"`
+}
+
+// SendPicItem is the picture sent by user.
+type SendPicItem struct {
+	PicMd5Sum string
+}
+
+// SendLocationInfo is the location of location_select event.
+type SendLocationInfo struct {
+	LocationX float64 `xml:"Location_X"`
+	LocationY float64 `xml:"Location_Y"`
+	Scale     int
+	Label     string
+	Poiname   string
 }
 
 // Music is the response of music message.
@@ -308,6 +442,10 @@ type responseWriter struct {
 	writer       http.ResponseWriter
 	toUserName   string
 	fromUserName string
+	encrypted    bool
+	timestamp    string
+	nonce        string
+	record       *[]byte // the plain reply is remembered if not nil
 }
 
 type response struct {
@@ -318,11 +456,6 @@ type response struct {
 // HandlerFunc is callback function handler
 type HandlerFunc func(ResponseWriter, *Request)
 
-type route struct {
-	regex   *regexp.Regexp
-	handler HandlerFunc
-}
-
 // AccessToken define weixin access token.
 type AccessToken struct {
 	Token   string
@@ -336,15 +469,55 @@ type jsAPITicket struct {
 
 // Weixin instance
 type Weixin struct {
-	token          string
-	routes         []*route
-	tokenChan      chan AccessToken
-	ticketChan     chan jsAPITicket
-	userData       interface{}
-	appID          string
-	appSecret      string
-	refreshToken   int32
-	encodingAESKey []byte
+	token        string
+	routes       []*route
+	exactRoutes  map[string][]*route
+	routeSeq     int
+	notFound     HandlerFunc
+	notFoundHook func(*Request)
+	middlewares  []Middleware
+	accessToken  *tokenCache
+	jsAPITicket  *tokenCache
+	userData     interface{}
+	appID        string
+	appSecret    string
+	crypt        *MsgCrypt
+	tokenStore   TokenStore
+	tokenClient  *tokenClient
+	httpClient   *http.Client
+	apiHost      string
+	fileHost     string
+	retryPolicy  RetryPolicy
+	stableToken  bool
+	replayWindow time.Duration
+	replayCache  Cache
+	dedupTTL     time.Duration
+	dedupCache   Cache
+	replyTimeout time.Duration
+	ipAllowlist  *ipAllowlist
+	closeOnce    sync.Once
+	done         chan struct{}
+	mutex        sync.Mutex
+	closed       bool
+	inflight     sync.WaitGroup
+}
+
+// ErrClosed is returned when the Weixin instance is closed.
+var ErrClosed = errors.New("WeiXin instance closed")
+
+var errNoAppSecret = errors.New("WeiXin app id or secret is empty")
+
+var errNoAccessToken = errors.New("WeiXin get access token failed")
+
+// Option is used to configure Weixin instance.
+type Option func(*Weixin)
+
+// WithTokenStore set the store of access token, instances use the same
+// store share one access token.
+func WithTokenStore(store TokenStore) Option {
+	return func(wx *Weixin) {
+		wx.tokenStore = store
+	}
 }
 
 // ToURL convert qr scene to url.
@@ -352,37 +525,152 @@ func (qr *QRScene) ToURL() string {
 	return (weixinShowQRScene + "?ticket=" + qr.Ticket)
 }
 
+// WithHTTPClient set the http client used to call weixin API.
+func WithHTTPClient(client *http.Client) Option {
+	return func(wx *Weixin) {
+		wx.httpClient = client
+	}
+}
+
+// WithAPIHost set the host of weixin API, such as APIHostShanghai.
+func WithAPIHost(host string) Option {
+	return func(wx *Weixin) {
+		wx.apiHost = strings.TrimSuffix(host, "/")
+	}
+}
+
+// WithFileHost set the host of weixin media API.
+func WithFileHost(host string) Option {
+	return func(wx *Weixin) {
+		wx.fileHost = strings.TrimSuffix(host, "/")
+	}
+}
+
+// WithStableToken get access token from stable_token API, the token is not
+// invalidated by other services fetching token of the same app id.
+func WithStableToken() Option {
+	return func(wx *Weixin) {
+		wx.stableToken = true
+	}
+}
+
+// WithReplayGuard reject the callback requests whose timestamp is not within
+// window of now, or whose nonce was seen before, the nonces are remembered
+// in cache (in memory if nil).
+func WithReplayGuard(window time.Duration, cache Cache) Option {
+	return func(wx *Weixin) {
+		if cache == nil {
+			cache = NewMemoryCache()
+		}
+		wx.replayWindow = window
+		wx.replayCache = cache
+	}
+}
+
 // New create a Weixin instance.
-func New(token string, appid string, secret string) *Weixin {
+func New(token string, appid string, secret string, opts ...Option) *Weixin {
 	wx := &Weixin{}
 	wx.token = token
 	wx.appID = appid
 	wx.appSecret = secret
-	wx.refreshToken = 0
-	wx.encodingAESKey = []byte{}
-	if len(appid) > 0 && len(secret) > 0 {
-		wx.tokenChan = make(chan AccessToken)
-		go wx.createAccessToken(wx.tokenChan, appid, secret)
-		wx.ticketChan = make(chan jsAPITicket)
-		go createJsAPITicket(wx.tokenChan, wx.ticketChan)
+	wx.httpClient = http.DefaultClient
+	wx.apiHost = APIHostDefault
+	wx.fileHost = FileHostDefault
+	wx.retryPolicy = DefaultRetryPolicy
+	for _, opt := range opts {
+		opt(wx)
+	}
+	if wx.tokenClient != nil {
+		wx.tokenClient.httpClient = wx.httpClient
+	}
+	if wx.tokenStore == nil {
+		wx.tokenStore = NewMemoryTokenStore()
+	}
+	wx.done = make(chan struct{})
+	// The tokens are fetched on first use.
+	if (len(appid) > 0 && len(secret) > 0) || wx.tokenClient != nil {
+		wx.accessToken = newTokenCache(wx.fetchAccessToken, wx.done)
+		wx.jsAPITicket = newTokenCache(wx.fetchJsAPITicket, wx.done)
+	}
+	if wx.ipAllowlist != nil {
+		go wx.ipAllowlist.run()
 	}
 	return wx
 }
 
+// Close stop the background work and reject new requests, the instance
+// can not be used after closed.
+func (wx *Weixin) Close() error {
+	wx.mutex.Lock()
+	wx.closed = true
+	wx.mutex.Unlock()
+	wx.closeOnce.Do(func() {
+		close(wx.done)
+	})
+	return nil
+}
+
+// Shutdown reject new requests and wait for the in-flight handlers in
+// ServeHTTP to finish before close, it returns the error of ctx if ctx is
+// done first, the instance is closed anyway.
+func (wx *Weixin) Shutdown(ctx context.Context) error {
+	wx.mutex.Lock()
+	wx.closed = true
+	wx.mutex.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		wx.inflight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	wx.Close() // nolint
+	return err
+}
+
+// enter count the in-flight request, return false if closed.
+func (wx *Weixin) enter() bool {
+	wx.mutex.Lock()
+	defer wx.mutex.Unlock()
+	if wx.closed {
+		return false
+	}
+	wx.inflight.Add(1)
+	return true
+}
+
+// backgroundContext return the context of requests in background, it is
+// canceled when the instance is closed.
+func (wx *Weixin) backgroundContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	go func() {
+		select {
+		case <-wx.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // NewWithUserData create data with userdata.
-func NewWithUserData(token string, appid string, secret string, userData interface{}) *Weixin {
-	wx := New(token, appid, secret)
+func NewWithUserData(token string, appid string, secret string, userData interface{}, opts ...Option) *Weixin {
+	wx := New(token, appid, secret, opts...)
 	wx.userData = userData
 	return wx
 }
 
 // SetEncodingAESKey set AES key
 func (wx *Weixin) SetEncodingAESKey(key string) error {
-	k, err := base64.StdEncoding.DecodeString(key + "=")
+	crypt, err := NewMsgCrypt(wx.token, key, wx.appID)
 	if err != nil {
 		return err
 	}
-	wx.encodingAESKey = k
+	wx.crypt = crypt
 	return nil
 }
 
@@ -398,19 +686,26 @@ func (wx *Weixin) GetAppSecret() string {
 
 // RefreshAccessToken update access token.
 func (wx *Weixin) RefreshAccessToken() {
-	atomic.StoreInt32(&wx.refreshToken, 1)
-	<-wx.tokenChan
+	wx.RefreshAccessTokenContext(context.Background())
+}
+
+// RefreshAccessTokenContext update access token with context.
+func (wx *Weixin) RefreshAccessTokenContext(ctx context.Context) {
+	wx.invalidateAccessToken(ctx, "")
 }
 
 // GetAccessToken read access token.
 func (wx *Weixin) GetAccessToken() AccessToken {
-	for i := 0; i < retryMaxN; i++ {
-		token := <-wx.tokenChan
-		if time.Since(token.Expires).Seconds() < 0 {
-			return token
-		}
+	return wx.GetAccessTokenContext(context.Background())
+}
+
+// GetAccessTokenContext read access token with context.
+func (wx *Weixin) GetAccessTokenContext(ctx context.Context) AccessToken {
+	token, err := wx.getAccessToken(ctx)
+	if err != nil {
+		return AccessToken{}
 	}
-	return AccessToken{}
+	return token
 }
 
 // HandleFunc used to register request callback.
@@ -419,12 +714,16 @@ func (wx *Weixin) HandleFunc(pattern string, handler HandlerFunc) {
 	if err != nil {
 		panic(err)
 	}
-	route := &route{regex, handler}
-	wx.routes = append(wx.routes, route)
+	wx.addRoute(&route{regex: regex, handler: handler})
 }
 
 // PostText used to post text message.
 func (wx *Weixin) PostText(touser string, text string) error {
+	return wx.PostTextContext(context.Background(), touser, text)
+}
+
+// PostTextContext used to post text message with context.
+func (wx *Weixin) PostTextContext(ctx context.Context, touser string, text string) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
@@ -435,11 +734,16 @@ func (wx *Weixin) PostText(touser string, text string) error {
 	msg.ToUser = touser
 	msg.MsgType = "text"
 	msg.Text.Content = text
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // PostImage used to post image message.
 func (wx *Weixin) PostImage(touser string, mediaID string) error {
+	return wx.PostImageContext(context.Background(), touser, mediaID)
+}
+
+// PostImageContext used to post image message with context.
+func (wx *Weixin) PostImageContext(ctx context.Context, touser string, mediaID string) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
@@ -450,11 +754,16 @@ func (wx *Weixin) PostImage(touser string, mediaID string) error {
 	msg.ToUser = touser
 	msg.MsgType = "image"
 	msg.Image.MediaID = mediaID
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // PostVoice used to post voice message.
 func (wx *Weixin) PostVoice(touser string, mediaID string) error {
+	return wx.PostVoiceContext(context.Background(), touser, mediaID)
+}
+
+// PostVoiceContext used to post voice message with context.
+func (wx *Weixin) PostVoiceContext(ctx context.Context, touser string, mediaID string) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
@@ -465,11 +774,16 @@ func (wx *Weixin) PostVoice(touser string, mediaID string) error {
 	msg.ToUser = touser
 	msg.MsgType = "voice"
 	msg.Voice.MediaID = mediaID
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // PostVideo used to post video message.
 func (wx *Weixin) PostVideo(touser string, m string, t string, d string) error {
+	return wx.PostVideoContext(context.Background(), touser, m, t, d)
+}
+
+// PostVideoContext used to post video message with context.
+func (wx *Weixin) PostVideoContext(ctx context.Context, touser string, m string, t string, d string) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
@@ -484,24 +798,34 @@ func (wx *Weixin) PostVideo(touser string, m string, t string, d string) error {
 	msg.Video.MediaID = m
 	msg.Video.Title = t
 	msg.Video.Description = d
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // PostMusic used to post music message.
 func (wx *Weixin) PostMusic(touser string, music *Music) error {
+	return wx.PostMusicContext(context.Background(), touser, music)
+}
+
+// PostMusicContext used to post music message with context.
+func (wx *Weixin) PostMusicContext(ctx context.Context, touser string, music *Music) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
 		Music   *Music `json:"music"`
 	}
 	msg.ToUser = touser
-	msg.MsgType = "video"
+	msg.MsgType = "music"
 	msg.Music = music
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // PostNews used to post news message.
 func (wx *Weixin) PostNews(touser string, articles []Article) error {
+	return wx.PostNewsContext(context.Background(), touser, articles)
+}
+
+// PostNewsContext used to post news message with context.
+func (wx *Weixin) PostNewsContext(ctx context.Context, touser string, articles []Article) error {
 	var msg struct {
 		ToUser  string `json:"touser"`
 		MsgType string `json:"msgtype"`
@@ -512,42 +836,67 @@ func (wx *Weixin) PostNews(touser string, articles []Article) error {
 	msg.ToUser = touser
 	msg.MsgType = "news"
 	msg.News.Articles = articles
-	return postMessage(wx.tokenChan, &msg)
+	return wx.postMessage(ctx, &msg)
 }
 
 // UploadMediaFromFile used to upload media from local file.
 func (wx *Weixin) UploadMediaFromFile(mediaType string, fp string) (string, error) {
+	return wx.UploadMediaFromFileContext(context.Background(), mediaType, fp)
+}
+
+// UploadMediaFromFileContext used to upload media from local file with context.
+func (wx *Weixin) UploadMediaFromFileContext(ctx context.Context, mediaType string, fp string) (string, error) {
 	file, err := os.Open(fp)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
-	return wx.UploadMedia(mediaType, filepath.Base(fp), file)
+	return wx.UploadMediaContext(ctx, mediaType, filepath.Base(fp), file)
 }
 
 // DownloadMediaToFile used to download media and save to local file.
 func (wx *Weixin) DownloadMediaToFile(mediaID string, fp string) error {
+	return wx.DownloadMediaToFileContext(context.Background(), mediaID, fp)
+}
+
+// DownloadMediaToFileContext used to download media and save to local file with context.
+func (wx *Weixin) DownloadMediaToFileContext(ctx context.Context, mediaID string, fp string) error {
 	file, err := os.Create(fp)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	return wx.DownloadMedia(mediaID, file)
+	return wx.DownloadMediaContext(ctx, mediaID, file)
 }
 
 // UploadMedia used to upload media with media.
 func (wx *Weixin) UploadMedia(mediaType string, filename string, reader io.Reader) (string, error) {
-	return uploadMedia(wx.tokenChan, mediaType, filename, reader)
+	return wx.UploadMediaContext(context.Background(), mediaType, filename, reader)
+}
+
+// UploadMediaContext used to upload media with media with context.
+func (wx *Weixin) UploadMediaContext(ctx context.Context, mediaType string, filename string, reader io.Reader) (string, error) {
+	return wx.uploadMedia(ctx, mediaType, filename, reader)
 }
 
 // DownloadMedia used to download media with media.
 func (wx *Weixin) DownloadMedia(mediaID string, writer io.Writer) error {
-	return downloadMedia(wx.tokenChan, mediaID, writer)
+	return wx.DownloadMediaContext(context.Background(), mediaID, writer)
+}
+
+// DownloadMediaContext used to download media with media with context.
+func (wx *Weixin) DownloadMediaContext(ctx context.Context, mediaID string, writer io.Writer) error {
+	return wx.downloadMedia(ctx, mediaID, writer)
 }
 
 // BatchGetMaterial used to batch get Material.
 func (wx *Weixin) BatchGetMaterial(materialType string, offset int, count int) (*Materials, error) {
-	reply, err := postRequest(weixinMaterialURL+"/batchget_material?access_token=", wx.tokenChan,
+	return wx.BatchGetMaterialContext(context.Background(), materialType, offset, count)
+}
+
+// BatchGetMaterialContext used to batch get Material with context.
+func (wx *Weixin) BatchGetMaterialContext(ctx context.Context, materialType string, offset int, count int) (*Materials, error) {
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinMaterialURL+"/batchget_material?access_token=", true,
 		[]byte(fmt.Sprintf(requestMaterial, materialType, offset, count)))
 	if err != nil {
 		return nil, err
@@ -561,7 +910,12 @@ func (wx *Weixin) BatchGetMaterial(materialType string, offset int, count int) (
 
 // GetIpList used to get ip list.
 func (wx *Weixin) GetIpList() ([]string, error) { // nolint
-	reply, err := sendGetRequest(weixinHost+"/getcallbackip?access_token=", wx.tokenChan)
+	return wx.GetIpListContext(context.Background())
+}
+
+// GetIpListContext used to get ip list with context.
+func (wx *Weixin) GetIpListContext(ctx context.Context) ([]string, error) {
+	reply, err := wx.sendGetRequest(ctx, wx.apiHost+weixinCgiBin+"/getcallbackip?access_token=")
 	if err != nil {
 		return nil, err
 	}
@@ -576,7 +930,12 @@ func (wx *Weixin) GetIpList() ([]string, error) { // nolint
 
 // CreateQRScene used to create QR scene.
 func (wx *Weixin) CreateQRScene(sceneID int, expires int) (*QRScene, error) {
-	reply, err := postRequest(weixinQRScene+"/create?access_token=", wx.tokenChan, []byte(fmt.Sprintf(requestQRScene, expires, sceneID)))
+	return wx.CreateQRSceneContext(context.Background(), sceneID, expires)
+}
+
+// CreateQRSceneContext used to create QR scene with context.
+func (wx *Weixin) CreateQRSceneContext(ctx context.Context, sceneID int, expires int) (*QRScene, error) {
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinQRScene+"/create?access_token=", true, []byte(fmt.Sprintf(requestQRScene, expires, sceneID)))
 	if err != nil {
 		return nil, err
 	}
@@ -589,7 +948,12 @@ func (wx *Weixin) CreateQRScene(sceneID int, expires int) (*QRScene, error) {
 
 // CreateQRSceneByString used to create QR scene by str.
 func (wx *Weixin) CreateQRSceneByString(sceneStr string, expires int) (*QRScene, error) {
-	reply, err := postRequest(weixinQRScene+"/create?access_token=", wx.tokenChan, []byte(fmt.Sprintf(requestQRSceneStr, expires, sceneStr)))
+	return wx.CreateQRSceneByStringContext(context.Background(), sceneStr, expires)
+}
+
+// CreateQRSceneByStringContext used to create QR scene by str with context.
+func (wx *Weixin) CreateQRSceneByStringContext(ctx context.Context, sceneStr string, expires int) (*QRScene, error) {
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinQRScene+"/create?access_token=", true, []byte(fmt.Sprintf(requestQRSceneStr, expires, sceneStr)))
 	if err != nil {
 		return nil, err
 	}
@@ -602,7 +966,12 @@ func (wx *Weixin) CreateQRSceneByString(sceneStr string, expires int) (*QRScene,
 
 // CreateQRLimitScene used to create QR limit scene.
 func (wx *Weixin) CreateQRLimitScene(sceneID int) (*QRScene, error) {
-	reply, err := postRequest(weixinQRScene+"/create?access_token=", wx.tokenChan, []byte(fmt.Sprintf(requestQRLimitScene, sceneID)))
+	return wx.CreateQRLimitSceneContext(context.Background(), sceneID)
+}
+
+// CreateQRLimitSceneContext used to create QR limit scene with context.
+func (wx *Weixin) CreateQRLimitSceneContext(ctx context.Context, sceneID int) (*QRScene, error) {
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinQRScene+"/create?access_token=", true, []byte(fmt.Sprintf(requestQRLimitScene, sceneID)))
 	if err != nil {
 		return nil, err
 	}
@@ -615,7 +984,12 @@ func (wx *Weixin) CreateQRLimitScene(sceneID int) (*QRScene, error) {
 
 // CreateQRLimitSceneByString used to create QR limit scene by str.
 func (wx *Weixin) CreateQRLimitSceneByString(sceneStr string) (*QRScene, error) {
-	reply, err := postRequest(weixinQRScene+"/create?access_token=", wx.tokenChan, []byte(fmt.Sprintf(requestQRLimitSceneStr, sceneStr)))
+	return wx.CreateQRLimitSceneByStringContext(context.Background(), sceneStr)
+}
+
+// CreateQRLimitSceneByStringContext used to create QR limit scene by str with context.
+func (wx *Weixin) CreateQRLimitSceneByStringContext(ctx context.Context, sceneStr string) (*QRScene, error) {
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinQRScene+"/create?access_token=", true, []byte(fmt.Sprintf(requestQRLimitSceneStr, sceneStr)))
 	if err != nil {
 		return nil, err
 	}
@@ -628,6 +1002,11 @@ func (wx *Weixin) CreateQRLimitSceneByString(sceneStr string) (*QRScene, error)
 
 // ShortURL used to convert long url to short url
 func (wx *Weixin) ShortURL(url string) (string, error) {
+	return wx.ShortURLContext(context.Background(), url)
+}
+
+// ShortURLContext used to convert long url to short url with context.
+func (wx *Weixin) ShortURLContext(ctx context.Context, url string) (string, error) {
 	var request struct {
 		Action  string `json:"action"`
 		LongURL string `json:"long_url"`
@@ -638,7 +1017,7 @@ func (wx *Weixin) ShortURL(url string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	reply, err := postRequest(weixinShortURL+"?access_token=", wx.tokenChan, data)
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinShortURL+"?access_token=", true, data)
 	if err != nil {
 		return "", err
 	}
@@ -653,17 +1032,27 @@ func (wx *Weixin) ShortURL(url string) (string, error) {
 
 // CreateMenu used to create custom menu.
 func (wx *Weixin) CreateMenu(menu *Menu) error {
+	return wx.CreateMenuContext(context.Background(), menu)
+}
+
+// CreateMenuContext used to create custom menu with context.
+func (wx *Weixin) CreateMenuContext(ctx context.Context, menu *Menu) error {
 	data, err := marshal(menu)
 	if err != nil {
 		return err
 	}
-	_, err = postRequest(weixinHost+"/menu/create?access_token=", wx.tokenChan, data)
+	_, err = wx.postRequest(ctx, wx.apiHost+weixinCgiBin+"/menu/create?access_token=", true, data)
 	return err
 }
 
 // GetMenu used to get menu.
 func (wx *Weixin) GetMenu() (*Menu, error) {
-	reply, err := sendGetRequest(weixinHost+"/menu/get?access_token=", wx.tokenChan)
+	return wx.GetMenuContext(context.Background())
+}
+
+// GetMenuContext used to get menu with context.
+func (wx *Weixin) GetMenuContext(ctx context.Context) (*Menu, error) {
+	reply, err := wx.sendGetRequest(ctx, wx.apiHost+weixinCgiBin+"/menu/get?access_token=")
 	if err != nil {
 		return nil, err
 	}
@@ -678,12 +1067,22 @@ func (wx *Weixin) GetMenu() (*Menu, error) {
 
 // DeleteMenu used to delete menu.
 func (wx *Weixin) DeleteMenu() error {
-	_, err := sendGetRequest(weixinHost+"/menu/delete?access_token=", wx.tokenChan)
+	return wx.DeleteMenuContext(context.Background())
+}
+
+// DeleteMenuContext used to delete menu with context.
+func (wx *Weixin) DeleteMenuContext(ctx context.Context) error {
+	_, err := wx.sendGetRequest(ctx, wx.apiHost+weixinCgiBin+"/menu/delete?access_token=")
 	return err
 }
 
 // SetTemplateIndustry used to set template industry.
 func (wx *Weixin) SetTemplateIndustry(id1 string, id2 string) error {
+	return wx.SetTemplateIndustryContext(context.Background(), id1, id2)
+}
+
+// SetTemplateIndustryContext used to set template industry with context.
+func (wx *Weixin) SetTemplateIndustryContext(ctx context.Context, id1 string, id2 string) error {
 	var industry struct {
 		ID1 string `json:"industry_id1,omitempty"`
 		ID2 string `json:"industry_id2,omitempty"`
@@ -694,12 +1093,17 @@ func (wx *Weixin) SetTemplateIndustry(id1 string, id2 string) error {
 	if err != nil {
 		return err
 	}
-	_, err = postRequest(weixinTemplate+"/api_set_industry?access_token=", wx.tokenChan, data)
+	_, err = wx.postRequest(ctx, wx.apiHost+weixinTemplate+"/api_set_industry?access_token=", true, data)
 	return err
 }
 
 // AddTemplate used to add template.
 func (wx *Weixin) AddTemplate(shortid string) (string, error) {
+	return wx.AddTemplateContext(context.Background(), shortid)
+}
+
+// AddTemplateContext used to add template with context.
+func (wx *Weixin) AddTemplateContext(ctx context.Context, shortid string) (string, error) {
 	var request struct {
 		Shortid string `json:"template_id_short,omitempty"`
 	}
@@ -708,7 +1112,7 @@ func (wx *Weixin) AddTemplate(shortid string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	reply, err := postRequest(weixinTemplate+"/api_set_industry?access_token=", wx.tokenChan, data)
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinTemplate+"/api_set_industry?access_token=", false, data)
 	if err != nil {
 		return "", err
 	}
@@ -723,6 +1127,11 @@ func (wx *Weixin) AddTemplate(shortid string) (string, error) {
 
 // PostTemplateMessage used to post template message.
 func (wx *Weixin) PostTemplateMessage(touser string, templateid string, url string, data TmplData) (int32, error) {
+	return wx.PostTemplateMessageContext(context.Background(), touser, templateid, url, data)
+}
+
+// PostTemplateMessageContext used to post template message with context.
+func (wx *Weixin) PostTemplateMessageContext(ctx context.Context, touser string, templateid string, url string, data TmplData) (int32, error) {
 	var msg struct {
 		ToUser     string   `json:"touser"`
 		TemplateID string   `json:"template_id"`
@@ -737,7 +1146,7 @@ func (wx *Weixin) PostTemplateMessage(touser string, templateid string, url stri
 	if err != nil {
 		return 0, err
 	}
-	reply, err := postRequest(weixinHost+"/message/template/send?access_token=", wx.tokenChan, msgStr)
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinCgiBin+"/message/template/send?access_token=", false, msgStr)
 	if err != nil {
 		return 0, err
 	}
@@ -752,11 +1161,16 @@ func (wx *Weixin) PostTemplateMessage(touser string, templateid string, url stri
 
 // PostTemplateMessageMiniProgram 兼容模板消息跳转小程序
 func (wx *Weixin) PostTemplateMessageMiniProgram(msg *TmplMsg) (int64, error) {
+	return wx.PostTemplateMessageMiniProgramContext(context.Background(), msg)
+}
+
+// PostTemplateMessageMiniProgramContext 兼容模板消息跳转小程序，支持context
+func (wx *Weixin) PostTemplateMessageMiniProgramContext(ctx context.Context, msg *TmplMsg) (int64, error) {
 	msgStr, err := marshal(msg)
 	if err != nil {
 		return 0, err
 	}
-	reply, err := postRequest(weixinHost+"/message/template/send?access_token=", wx.tokenChan, msgStr)
+	reply, err := wx.postRequest(ctx, wx.apiHost+weixinCgiBin+"/message/template/send?access_token=", false, msgStr)
 	if err != nil {
 		return 0, err
 	}
@@ -776,17 +1190,29 @@ func (wx *Weixin) CreateRedirectURL(urlStr string, scope string, state string) s
 
 // GetUserAccessToken used to get open id
 func (wx *Weixin) GetUserAccessToken(code string) (*UserAccessToken, error) {
-	resp, err := http.Get(fmt.Sprintf(weixinUserAccessTokenURL, wx.appID, wx.appSecret, code))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return wx.GetUserAccessTokenContext(context.Background(), code)
+}
+
+// GetUserAccessTokenContext used to get open id with context.
+func (wx *Weixin) GetUserAccessTokenContext(ctx context.Context, code string) (*UserAccessToken, error) {
+	reqURL := wx.apiHost + fmt.Sprintf(weixinUserAccessTokenURL, wx.appID, wx.appSecret, code)
 	var res UserAccessToken
-	if err := json.Unmarshal(body, &res); err != nil {
+	// Not idempotent, the code can be used only once.
+	err := wx.retry(ctx, false, func() error {
+		r, err := wx.httpGet(ctx, reqURL)
+		if err != nil {
+			return err
+		}
+		reply, err := readReply(r, reqURL)
+		if err != nil {
+			return err
+		}
+		if err := checkReply(reqURL, reply); err != nil {
+			return err
+		}
+		return json.Unmarshal(reply, &res)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &res, nil
@@ -794,7 +1220,12 @@ func (wx *Weixin) GetUserAccessToken(code string) (*UserAccessToken, error) {
 
 // GetUserInfo used to get user info
 func (wx *Weixin) GetUserInfo(openid string) (*UserInfo, error) {
-	reply, err := sendGetRequest(fmt.Sprintf("%s?openid=%s&lang=zh_CN&access_token=", weixinUserInfo, openid), wx.tokenChan)
+	return wx.GetUserInfoContext(context.Background(), openid)
+}
+
+// GetUserInfoContext used to get user info with context.
+func (wx *Weixin) GetUserInfoContext(ctx context.Context, openid string) (*UserInfo, error) {
+	reply, err := wx.sendGetRequest(ctx, fmt.Sprintf("%s%s?openid=%s&lang=zh_CN&access_token=", wx.apiHost, weixinUserInfo, openid))
 	if err != nil {
 		return nil, err
 	}
@@ -807,18 +1238,37 @@ func (wx *Weixin) GetUserInfo(openid string) (*UserInfo, error) {
 
 // GetJsAPITicket used to get js api ticket.
 func (wx *Weixin) GetJsAPITicket() (string, error) {
-	for i := 0; i < retryMaxN; i++ {
-		ticket := <-wx.ticketChan
-		if time.Since(ticket.expires).Seconds() < 0 {
-			return ticket.ticket, nil
-		}
+	return wx.GetJsAPITicketContext(context.Background())
+}
+
+// GetJsAPITicketContext used to get js api ticket with context.
+func (wx *Weixin) GetJsAPITicketContext(ctx context.Context) (string, error) {
+	ticket, err := wx.getJsAPITicketWithExpires(ctx)
+	if err != nil {
+		return "", err
+	}
+	return ticket.ticket, nil
+}
+
+func (wx *Weixin) getJsAPITicketWithExpires(ctx context.Context) (jsAPITicket, error) {
+	if wx.jsAPITicket == nil {
+		return jsAPITicket{}, errNoAppSecret
+	}
+	ticket, err := wx.jsAPITicket.get(ctx)
+	if err != nil {
+		return jsAPITicket{}, err
 	}
-	return "", errors.New("Get JsApi Ticket Timeout")
+	return jsAPITicket{ticket.Token, ticket.Expires}, nil
 }
 
 // JsSignature used to sign js url.
 func (wx *Weixin) JsSignature(url string, timestamp int64, noncestr string) (string, error) {
-	ticket, err := wx.GetJsAPITicket()
+	return wx.JsSignatureContext(context.Background(), url, timestamp, noncestr)
+}
+
+// JsSignatureContext used to sign js url with context.
+func (wx *Weixin) JsSignatureContext(ctx context.Context, url string, timestamp int64, noncestr string) (string, error) {
+	ticket, err := wx.GetJsAPITicketContext(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -837,13 +1287,39 @@ func (wx *Weixin) CreateHandlerFunc(w http.ResponseWriter, r *http.Request) http
 
 // ServeHTTP used to process weixin request and send response.
 func (wx *Weixin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !checkSignature(wx.token, w, r) {
+	if !wx.enter() {
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+	defer wx.inflight.Done()
+	if wx.ipAllowlist != nil && !wx.ipAllowlist.allow(r) {
+		log.Println("Weixin reject request from:", r.RemoteAddr)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	r.ParseForm() // nolint
+	// Verify request in safe mode, the echostr is encrypted
+	if r.Method == "GET" && wx.crypt != nil && len(r.FormValue("msg_signature")) > 0 {
+		echo, err := wx.crypt.VerifyURL(r.FormValue("msg_signature"), r.FormValue("timestamp"), r.FormValue("nonce"), r.FormValue("echostr"))
+		if err != nil {
+			log.Println("Weixin verify url failed:", err)
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		if !wx.checkReplay(r) {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		w.Write(echo) // nolint
+		return
+	}
+	if !checkSignature(wx.token, w, r) || !wx.checkReplay(r) {
 		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
 	// Verify request
 	if r.Method == "GET" {
-		fmt.Fprintf(w, r.FormValue("echostr")) // nolint
+		w.Write([]byte(r.FormValue("echostr"))) // nolint
 		return
 	}
 	// Process message
@@ -858,71 +1334,68 @@ func (wx *Weixin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "", http.StatusBadRequest)
 			return
 		}
-		if len(wx.encodingAESKey) > 0 && len(msg.Encrypt) > 0 {
-			// check encrypt
-			d, err := base64.StdEncoding.DecodeString(msg.Encrypt)
+		// In compatible mode the message carries both plaintext fields and
+		// the Encrypt field, the decrypted content takes precedence.
+		encrypted := false
+		if wx.crypt != nil && len(msg.Encrypt) > 0 {
+			data, err = wx.crypt.DecryptMsg(r.FormValue("msg_signature"), r.FormValue("timestamp"), r.FormValue("nonce"), data)
 			if err != nil {
-				log.Println("Weixin decode base64 message failed:", err)
-				http.Error(w, "", http.StatusBadRequest)
-				return
-			}
-			if len(d) <= 20 {
-				log.Println("Weixin invalid aes message:", err)
+				log.Println("Weixin decrypt message failed:", err)
 				http.Error(w, "", http.StatusBadRequest)
 				return
 			}
-			// valid
-			strs := sort.StringSlice{wx.token, r.FormValue("timestamp"), r.FormValue("nonce"), msg.Encrypt}
-			sort.Strings(strs)
-			if fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(strs, "")))) != r.FormValue("msg_signature") {
-				log.Println("Weixin check message sign failed!")
-				http.Error(w, "", http.StatusBadRequest)
-				return
-			}
-			// decode
-			key := wx.encodingAESKey
-			b, err := aes.NewCipher(key)
-			if err != nil {
-				log.Println("Weixin create cipher failed:", err)
-				http.Error(w, "", http.StatusBadRequest)
-				return
-			}
-			bs := b.BlockSize()
-			bm := cipher.NewCBCDecrypter(b, key[:bs])
-			data = make([]byte, len(d))
-			bm.CryptBlocks(data, d)
-			data = fixPKCS7UnPadding(data)
-			len := binary.BigEndian.Uint32(data[16:20])
-			if err := xml.Unmarshal(data[20:(20+len)], &msg); err != nil {
+			if err := xml.Unmarshal(data, &msg); err != nil {
 				log.Println("Weixin parse aes message failed:", err)
 				http.Error(w, "", http.StatusBadRequest)
 				return
 			}
+			encrypted = true
+		}
+		msg.Raw = data
+		if msg.Fields, err = parseFields(data); err != nil {
+			log.Println("Weixin parse message fields failed:", err)
+		}
+		writer := responseWriter{}
+		writer.wx = wx
+		writer.writer = w
+		writer.toUserName = msg.FromUserName
+		writer.fromUserName = msg.ToUserName
+		writer.encrypted = encrypted
+		writer.timestamp = r.FormValue("timestamp")
+		writer.nonce = r.FormValue("nonce")
+		if wx.replyTimeout > 0 {
+			wx.handleWithDeadline(writer, &msg, wx.handleRequest)
+		} else {
+			wx.handleRequest(writer, &msg)
 		}
-		wx.routeRequest(w, &msg)
 	}
 	return
 }
 
-func (wx *Weixin) routeRequest(w http.ResponseWriter, r *Request) {
-	requestPath := r.MsgType
-	if requestPath == msgEvent {
-		requestPath += "." + r.Event
+func (wx *Weixin) handleRequest(writer responseWriter, r *Request) {
+	if wx.dedupCache != nil {
+		wx.dedupRequest(writer, r)
+	} else {
+		wx.routeRequest(writer, r)
 	}
-	for _, route := range wx.routes {
-		if !route.regex.MatchString(requestPath) {
-			continue
-		}
-		writer := responseWriter{}
-		writer.wx = wx
-		writer.writer = w
-		writer.toUserName = r.FromUserName
-		writer.fromUserName = r.ToUserName
-		route.handler(writer, r)
+}
+
+func (wx *Weixin) routeRequest(writer responseWriter, r *Request) {
+	if route := wx.matchRoute(r); route != nil {
+		chain(wx.middlewares, route.handler)(writer, r)
 		return
 	}
-	http.Error(w, "", http.StatusNotFound)
-	return
+	if wx.notFoundHook != nil {
+		wx.notFoundHook(r)
+	} else {
+		log.Println("Weixin no handler for message:", requestPath(r))
+	}
+	if wx.notFound != nil {
+		chain(wx.middlewares, wx.notFound)(writer, r)
+		return
+	}
+	// Weixin show the user an error on 404, reply empty message instead.
+	writer.ReplyOK()
 }
 
 func marshal(v interface{}) ([]byte, error) {
@@ -935,10 +1408,34 @@ func marshal(v interface{}) ([]byte, error) {
 	return data, err
 }
 
-func fixPKCS7UnPadding(data []byte) []byte {
-	length := len(data)
-	unpadding := int(data[length-1])
-	return data[:(length - unpadding)]
+// checkReplay check the timestamp and nonce of signed request if replay
+// guard is enabled.
+func (wx *Weixin) checkReplay(r *http.Request) bool {
+	if wx.replayCache == nil {
+		return true
+	}
+	timestamp := r.FormValue("timestamp")
+	nonce := r.FormValue("nonce")
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(nonce) <= 0 {
+		log.Println("Weixin invalid timestamp or nonce:", timestamp, nonce)
+		return false
+	}
+	if d := time.Since(time.Unix(t, 0)); d > wx.replayWindow || d < -wx.replayWindow {
+		log.Println("Weixin request timestamp out of window:", timestamp)
+		return false
+	}
+	// Timestamps within the window are accepted, so remember the nonce for
+	// twice of the window.
+	added, err := wx.replayCache.Add("weixin:nonce:"+timestamp+":"+nonce, []byte{}, 2*wx.replayWindow)
+	if err != nil {
+		log.Println("Weixin check nonce failed:", err)
+		return false
+	}
+	if !added {
+		log.Println("Weixin replayed request:", timestamp, nonce)
+	}
+	return added
 }
 
 func checkSignature(t string, w http.ResponseWriter, r *http.Request) bool {
@@ -946,44 +1443,145 @@ func checkSignature(t string, w http.ResponseWriter, r *http.Request) bool {
 	signature := r.FormValue("signature")
 	timestamp := r.FormValue("timestamp")
 	nonce := r.FormValue("nonce")
-	strs := sort.StringSlice{t, timestamp, nonce}
-	sort.Strings(strs)
-	var str string
-	for _, s := range strs {
-		str += s
+	return subtle.ConstantTimeCompare([]byte(Signature(t, timestamp, nonce)), []byte(signature)) == 1
+}
+
+func (wx *Weixin) authAccessToken(stale string, force bool) (string, time.Duration) {
+	ctx, cancel := wx.backgroundContext()
+	defer cancel()
+	if wx.stableToken {
+		token, expires, err := wx.authStableAccessToken(ctx, false)
+		// Force refresh only when the stale token is invalid, the times of
+		// force refresh are limited.
+		if err == nil && force && token == stale {
+			token, expires, err = wx.authStableAccessToken(ctx, true)
+		}
+		if err != nil {
+			log.Println("Get stable access token failed: ", err)
+			return "", 0
+		}
+		return token, expires
 	}
-	h := sha1.New()
-	h.Write([]byte(str)) // nolint
-	return fmt.Sprintf("%x", h.Sum(nil)) == signature
+	reqURL := wx.apiHost + weixinCgiBin + "/token?grant_type=client_credential&appid=" + wx.appID + "&secret=" + wx.appSecret
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err := wx.retry(ctx, true, func() error {
+		r, err := wx.httpGet(ctx, reqURL)
+		if err != nil {
+			return err
+		}
+		reply, err := readReply(r, reqURL)
+		if err != nil {
+			return err
+		}
+		if err := checkReply(reqURL, reply); err != nil {
+			return err
+		}
+		return json.Unmarshal(reply, &res)
+	})
+	if err != nil {
+		log.Println("Get access token failed: ", err)
+		return "", 0
+	}
+	//log.Printf("AuthAccessToken token=%s expires_in=%d", res.AccessToken, res.ExpiresIn)
+	return res.AccessToken, time.Duration(res.ExpiresIn * 1000 * 1000 * 1000)
 }
 
-func authAccessToken(appid string, secret string) (string, time.Duration) {
-	resp, err := http.Get(weixinHost + "/token?grant_type=client_credential&appid=" + appid + "&secret=" + secret)
+func (wx *Weixin) authStableAccessToken(ctx context.Context, force bool) (string, time.Duration, error) {
+	var request struct {
+		GrantType    string `json:"grant_type"`
+		AppID        string `json:"appid"`
+		Secret       string `json:"secret"`
+		ForceRefresh bool   `json:"force_refresh"`
+	}
+	request.GrantType = "client_credential"
+	request.AppID = wx.appID
+	request.Secret = wx.appSecret
+	request.ForceRefresh = force
+	data, err := marshal(request)
 	if err != nil {
-		log.Println("Get access token failed: ", err)
-	} else {
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+		return "", 0, err
+	}
+	reqURL := wx.apiHost + weixinCgiBin + "/stable_token"
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = wx.retry(ctx, !force, func() error {
+		r, err := wx.httpPost(ctx, reqURL, "application/json; charset=utf-8", bytes.NewReader(data))
 		if err != nil {
-			log.Println("Read access token failed: ", err)
-		} else {
-			var res struct {
-				AccessToken string `json:"access_token"`
-				ExpiresIn   int64  `json:"expires_in"`
+			return err
+		}
+		reply, err := readReply(r, reqURL)
+		if err != nil {
+			return err
+		}
+		if err := checkReply(reqURL, reply); err != nil {
+			return err
+		}
+		return json.Unmarshal(reply, &res)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return res.AccessToken, time.Duration(res.ExpiresIn * 1000 * 1000 * 1000), nil
+}
+
+// loadAccessToken read access token from store, if it is expired or same as
+// stale, the instance holds the refresh lock fetch a new one.
+func (wx *Weixin) loadAccessToken(stale string, force bool) AccessToken {
+	if wx.tokenClient != nil {
+		return wx.tokenClient.accessToken(force, stale)
+	}
+	store := wx.tokenStore
+	for i := 0; i < tokenLockRetry; i++ {
+		token, err := store.Load(wx.appID)
+		if err != nil {
+			log.Println("Load access token failed: ", err)
+			break
+		}
+		if len(token.Token) > 0 && token.Token != stale && time.Since(token.Expires).Seconds() < 0 {
+			return token
+		}
+		locked, err := store.Lock(wx.appID, tokenLockTTL)
+		if err != nil {
+			log.Println("Lock access token failed: ", err)
+			break
+		}
+		if locked {
+			// Check again, the token may be refreshed before locked.
+			token, err = store.Load(wx.appID)
+			if err != nil || len(token.Token) <= 0 || token.Token == stale || time.Since(token.Expires).Seconds() >= 0 {
+				var expires time.Duration
+				token.Token, expires = wx.authAccessToken(stale, force)
+				token.Expires = time.Now().Add(expires)
+				if len(token.Token) > 0 {
+					if err := store.Store(wx.appID, token); err != nil {
+						log.Println("Store access token failed: ", err)
+					}
+				}
 			}
-			if err := json.Unmarshal(body, &res); err != nil {
-				log.Println("Parse access token failed: ", err)
-			} else {
-				//log.Printf("AuthAccessToken token=%s expires_in=%d", res.AccessToken, res.ExpiresIn)
-				return res.AccessToken, time.Duration(res.ExpiresIn * 1000 * 1000 * 1000)
+			if err := store.Unlock(wx.appID); err != nil {
+				log.Println("Unlock access token failed: ", err)
 			}
+			return token
 		}
+		// Another instance is refreshing, wait for it.
+		time.Sleep(tokenLockWait)
 	}
-	return "", 0
+	var token AccessToken
+	var expires time.Duration
+	token.Token, expires = wx.authAccessToken(stale, force)
+	token.Expires = time.Now().Add(expires)
+	return token
 }
 
-func getJsAPITicket(c chan AccessToken) (*jsAPITicket, error) {
-	reply, err := sendGetRequest(weixinJsApiTicketURL+"?type=jsapi&access_token=", c)
+func (wx *Weixin) getJsAPITicket() (*jsAPITicket, error) {
+	ctx, cancel := wx.backgroundContext()
+	defer cancel()
+	reply, err := wx.sendGetRequest(ctx, wx.apiHost+weixinJsApiTicketURL+"?type=jsapi&access_token=")
 	if err != nil {
 		return nil, err
 	}
@@ -1001,185 +1599,193 @@ func getJsAPITicket(c chan AccessToken) (*jsAPITicket, error) {
 
 }
 
-func (wx *Weixin) createAccessToken(c chan AccessToken, appid string, secret string) {
-	token := AccessToken{"", time.Now()}
-	c <- token
-	for {
-		swapped := atomic.CompareAndSwapInt32(&wx.refreshToken, 1, 0)
-		if swapped || time.Since(token.Expires).Seconds() >= 0 {
-			var expires time.Duration
-			token.Token, expires = authAccessToken(appid, secret)
-			token.Expires = time.Now().Add(expires)
-		}
-		c <- token
+func (wx *Weixin) fetchAccessToken(stale string, force bool) (AccessToken, error) {
+	token := wx.loadAccessToken(stale, force)
+	if len(token.Token) <= 0 {
+		return token, errNoAccessToken
 	}
+	return token, nil
 }
 
-func createJsAPITicket(cin chan AccessToken, c chan jsAPITicket) {
-	ticket := jsAPITicket{"", time.Now()}
-	c <- ticket
-	for {
-		if time.Since(ticket.expires).Seconds() >= 0 {
-			t, err := getJsAPITicket(cin)
-			if err == nil {
-				ticket = *t
-			}
-		}
-		c <- ticket
+// invalidateAccessToken refresh the access token if it is still stale,
+// refresh anyway if stale is empty.
+func (wx *Weixin) invalidateAccessToken(ctx context.Context, stale string) {
+	if wx.accessToken == nil {
+		return
+	}
+	if _, err := wx.accessToken.invalidate(ctx, stale); err != nil {
+		log.Println("Refresh access token failed: ", err)
 	}
 }
+func (wx *Weixin) fetchJsAPITicket(stale string, force bool) (AccessToken, error) {
+	var t *jsAPITicket
+	var err error
+	if wx.tokenClient != nil {
+		t, err = wx.tokenClient.jsAPITicket()
+	} else {
+		t, err = wx.getJsAPITicket()
+	}
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return AccessToken{t.ticket, t.expires}, nil
+}
 
-func sendGetRequest(reqURL string, c chan AccessToken) ([]byte, error) {
-	for i := 0; i < retryMaxN; i++ {
-		token := <-c
-		if time.Since(token.Expires).Seconds() < 0 {
-			r, err := http.Get(reqURL + token.Token)
-			if err != nil {
-				return nil, err
-			}
-			defer r.Body.Close()
-			reply, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return nil, err
-			}
-			var result response
-			if err := json.Unmarshal(reply, &result); err != nil {
-				return nil, err
-			}
-			switch result.ErrorCode {
-			case 0:
-				return reply, nil
-			case 42001: // access_token timeout and retry
-				continue
-			default:
-				return nil, fmt.Errorf("WeiXin send get request reply[%d]: %s", result.ErrorCode, result.ErrorMessage)
-			}
-		}
+func (wx *Weixin) getAccessToken(ctx context.Context) (AccessToken, error) {
+	if wx.accessToken == nil {
+		return AccessToken{}, errNoAppSecret
 	}
-	return nil, errors.New("WeiXin post request too many times:" + reqURL)
+	return wx.accessToken.get(ctx)
 }
 
-func postRequest(reqURL string, c chan AccessToken, data []byte) ([]byte, error) {
-	for i := 0; i < retryMaxN; i++ {
-		token := <-c
-		if time.Since(token.Expires).Seconds() < 0 {
-			r, err := http.Post(reqURL+token.Token, "application/json; charset=utf-8", bytes.NewReader(data))
-			if err != nil {
-				return nil, err
-			}
-			defer r.Body.Close()
-			reply, err := ioutil.ReadAll(r.Body)
+func (wx *Weixin) httpGet(ctx context.Context, reqURL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, redactURLError(err, reqURL)
+	}
+	r, err := wx.httpClient.Do(req.WithContext(ctx))
+	return r, redactURLError(err, reqURL)
+}
+
+func (wx *Weixin) httpPost(ctx context.Context, reqURL string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", reqURL, body)
+	if err != nil {
+		return nil, redactURLError(err, reqURL)
+	}
+	req.Header.Set("Content-Type", contentType)
+	r, err := wx.httpClient.Do(req.WithContext(ctx))
+	return r, redactURLError(err, reqURL)
+}
+
+// readReply read the body of weixin API reply.
+func readReply(r *http.Response, reqURL string) ([]byte, error) {
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		return nil, &httpStatusError{r.StatusCode, endpointOf(reqURL)}
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// checkReply return the error in weixin API reply.
+func checkReply(reqURL string, reply []byte) error {
+	var result response
+	if err := json.Unmarshal(reply, &result); err != nil {
+		return err
+	}
+	if result.ErrorCode != 0 {
+		return newAPIError(reqURL, result.ErrorCode, result.ErrorMessage)
+	}
+	return nil
+}
+
+// call send request with access token, the token is refreshed and the
+// request is sent again if the token is invalid, send return the reply
+// to check or nil if the reply is handled.
+func (wx *Weixin) call(ctx context.Context, reqURL string, idempotent bool, send func(token string) ([]byte, error)) ([]byte, error) {
+	var reply []byte
+	err := wx.retry(ctx, idempotent, func() error {
+		for i := 0; ; i++ {
+			token, err := wx.getAccessToken(ctx)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			var result response
-			if err := json.Unmarshal(reply, &result); err != nil {
-				return nil, err
+			reply, err = send(token.Token)
+			if err == nil && reply != nil {
+				err = checkReply(reqURL, reply)
 			}
-			switch result.ErrorCode {
-			case 0:
-				return reply, nil
-			case 42001: // access_token timeout and retry
-				continue
-			default:
-				return nil, fmt.Errorf("WeiXin send post request reply[%d]: %s", result.ErrorCode, result.ErrorMessage)
+			if !IsTokenInvalid(err) || i >= retryMaxN-1 {
+				return err
 			}
+			// access_token is invalid, refresh and retry
+			wx.invalidateAccessToken(ctx, token.Token)
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("WeiXin post request too many times:" + reqURL)
+	return reply, nil
 }
 
-func postMessage(c chan AccessToken, msg interface{}) error {
+func (wx *Weixin) sendGetRequest(ctx context.Context, reqURL string) ([]byte, error) {
+	return wx.call(ctx, reqURL, true, func(token string) ([]byte, error) {
+		r, err := wx.httpGet(ctx, reqURL+token)
+		if err != nil {
+			return nil, err
+		}
+		return readReply(r, reqURL)
+	})
+}
+
+func (wx *Weixin) postRequest(ctx context.Context, reqURL string, idempotent bool, data []byte) ([]byte, error) {
+	return wx.call(ctx, reqURL, idempotent, func(token string) ([]byte, error) {
+		r, err := wx.httpPost(ctx, reqURL+token, "application/json; charset=utf-8", bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return readReply(r, reqURL)
+	})
+}
+
+func (wx *Weixin) postMessage(ctx context.Context, msg interface{}) error {
 	data, err := marshal(msg)
 	if err != nil {
 		return err
 	}
-	_, err = postRequest(weixinHost+"/message/custom/send?access_token=", c, data)
+	_, err = wx.postRequest(ctx, wx.apiHost+weixinCgiBin+"/message/custom/send?access_token=", false, data)
 	return err
 }
 
-// nolint: gocyclo
-func uploadMedia(c chan AccessToken, mediaType string, filename string, reader io.Reader) (string, error) {
-	reqURL := weixinFileURL + "/upload?type=" + mediaType + "&access_token="
-	for i := 0; i < retryMaxN; i++ {
-		token := <-c
-		if time.Since(token.Expires).Seconds() < 0 {
-			bodyBuf := &bytes.Buffer{}
-			bodyWriter := multipart.NewWriter(bodyBuf)
-			fileWriter, err := bodyWriter.CreateFormFile("filename", filename)
-			if err != nil {
-				return "", err
-			}
-			if _, err = io.Copy(fileWriter, reader); err != nil {
-				return "", err
-			}
-			contentType := bodyWriter.FormDataContentType()
-			bodyWriter.Close() // nolint
-			r, err := http.Post(reqURL+token.Token, contentType, bodyBuf)
-			if err != nil {
-				return "", err
-			}
-			defer r.Body.Close()
-			reply, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return "", err
-			}
-			var result struct {
-				response
-				Type      string `json:"type"`
-				MediaID   string `json:"media_id"`
-				CreatedAt int64  `json:"created_at"`
-			}
-			err = json.Unmarshal(reply, &result)
-			if err != nil {
-				return "", err
-			}
-			switch result.ErrorCode {
-			case 0:
-				return result.MediaID, nil
-			case 42001: // access_token timeout and retry
-				continue
-			default:
-				return "", fmt.Errorf("WeiXin upload[%d]: %s", result.ErrorCode, result.ErrorMessage)
-			}
+func (wx *Weixin) uploadMedia(ctx context.Context, mediaType string, filename string, reader io.Reader) (string, error) {
+	reqURL := wx.fileHost + weixinFileURL + "/upload?type=" + mediaType + "&access_token="
+	// Read the media once, it is sent again on retry.
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+	fileWriter, err := bodyWriter.CreateFormFile("filename", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(fileWriter, reader); err != nil {
+		return "", err
+	}
+	contentType := bodyWriter.FormDataContentType()
+	bodyWriter.Close() // nolint
+	reply, err := wx.call(ctx, reqURL, true, func(token string) ([]byte, error) {
+		r, err := wx.httpPost(ctx, reqURL+token, contentType, bytes.NewReader(bodyBuf.Bytes()))
+		if err != nil {
+			return nil, err
 		}
+		return readReply(r, reqURL)
+	})
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Type      string `json:"type"`
+		MediaID   string `json:"media_id"`
+		CreatedAt int64  `json:"created_at"`
 	}
-	return "", errors.New("WeiXin upload media too many times")
+	if err := json.Unmarshal(reply, &result); err != nil {
+		return "", err
+	}
+	return result.MediaID, nil
 }
 
-func downloadMedia(c chan AccessToken, mediaID string, writer io.Writer) error {
-	reqURL := weixinFileURL + "/get?media_id=" + mediaID + "&access_token="
-	for i := 0; i < retryMaxN; i++ {
-		token := <-c
-		if time.Since(token.Expires).Seconds() < 0 {
-			r, err := http.Get(reqURL + token.Token)
-			if err != nil {
-				return err
-			}
+func (wx *Weixin) downloadMedia(ctx context.Context, mediaID string, writer io.Writer) error {
+	reqURL := wx.fileHost + weixinFileURL + "/get?media_id=" + mediaID + "&access_token="
+	// Not idempotent, the writer can not be rewound after written.
+	_, err := wx.call(ctx, reqURL, false, func(token string) ([]byte, error) {
+		r, err := wx.httpGet(ctx, reqURL+token)
+		if err != nil {
+			return nil, err
+		}
+		if r.Header.Get("Content-Type") != "text/plain" {
 			defer r.Body.Close()
-			if r.Header.Get("Content-Type") != "text/plain" {
-				_, err = io.Copy(writer, r.Body)
-				return err
-			}
-			reply, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return err
-			}
-			var result response
-			if err := json.Unmarshal(reply, &result); err != nil {
-				return err
-			}
-			switch result.ErrorCode {
-			case 0:
-				return nil
-			case 42001: // access_token timeout and retry
-				continue
-			default:
-				return fmt.Errorf("WeiXin download[%d]: %s", result.ErrorCode, result.ErrorMessage)
-			}
+			_, err = io.Copy(writer, r.Body)
+			return nil, err
 		}
-	}
-	return errors.New("WeiXin download media too many times")
+		return readReply(r, reqURL)
+	})
+	return err
 }
 
 // Format reply message header.
@@ -1198,38 +1804,88 @@ func (w responseWriter) GetUserData() interface{} {
 }
 
 func (w responseWriter) replyMsg(msg string) {
-	w.writer.Write([]byte(msg))
+	w.writeReply(msg)
+}
+
+// writeReply write the reply message, return false if the reply deadline
+// is exceeded.
+func (w responseWriter) writeReply(msg string) bool {
+	data := []byte(msg)
+	if w.encrypted {
+		var err error
+		data, err = w.wx.crypt.EncryptMsg(data, w.timestamp, w.nonce)
+		if err != nil {
+			log.Println("Weixin encrypt reply message failed:", err)
+			http.Error(w.writer, "", http.StatusInternalServerError)
+			return true
+		}
+	}
+	if _, err := w.writer.Write(data); err == errReplyExpired {
+		return false
+	}
+	if w.record != nil {
+		*w.record = []byte(msg)
+	}
+	return true
+}
+
+// reply write the reply message, or send it by post if the reply deadline
+// is exceeded.
+func (w responseWriter) reply(msg string, post func() error) {
+	if w.writeReply(msg) {
+		return
+	}
+	if post == nil {
+		log.Println("Weixin reply after deadline is dropped")
+		return
+	}
+	if err := post(); err != nil {
+		log.Println("Weixin post reply after deadline failed:", err)
+	}
 }
 
 // ReplyOK used to reply empty message.
 func (w responseWriter) ReplyOK() {
-	w.replyMsg("success")
+	// "success" is accepted without encryption in any mode
+	if _, err := w.writer.Write([]byte("success")); err == nil && w.record != nil {
+		*w.record = []byte("success")
+	}
 }
 
 // ReplyText used to reply text message.
 func (w responseWriter) ReplyText(text string) {
-	w.replyMsg(fmt.Sprintf(replyText, w.replyHeader(), text))
+	w.reply(fmt.Sprintf(replyText, w.replyHeader(), text), func() error {
+		return w.PostText(text)
+	})
 }
 
 // ReplyImage used to reply image message.
 func (w responseWriter) ReplyImage(mediaID string) {
-	w.replyMsg(fmt.Sprintf(replyImage, w.replyHeader(), mediaID))
+	w.reply(fmt.Sprintf(replyImage, w.replyHeader(), mediaID), func() error {
+		return w.PostImage(mediaID)
+	})
 }
 
 // ReplyVoice used to reply voice message.
 func (w responseWriter) ReplyVoice(mediaID string) {
-	w.replyMsg(fmt.Sprintf(replyVoice, w.replyHeader(), mediaID))
+	w.reply(fmt.Sprintf(replyVoice, w.replyHeader(), mediaID), func() error {
+		return w.PostVoice(mediaID)
+	})
 }
 
 // ReplyVideo used to reply video message
 func (w responseWriter) ReplyVideo(mediaID string, title string, description string) {
-	w.replyMsg(fmt.Sprintf(replyVideo, w.replyHeader(), mediaID, title, description))
+	w.reply(fmt.Sprintf(replyVideo, w.replyHeader(), mediaID, title, description), func() error {
+		return w.PostVideo(mediaID, title, description)
+	})
 }
 
 // ReplyMusic used to reply music message
 func (w responseWriter) ReplyMusic(m *Music) {
 	msg := fmt.Sprintf(replyMusic, w.replyHeader(), m.Title, m.Description, m.MusicUrl, m.HQMusicUrl, m.ThumbMediaId)
-	w.replyMsg(msg)
+	w.reply(msg, func() error {
+		return w.PostMusic(m)
+	})
 }
 
 // ReplyNews used to reply news message (max 10 news)
@@ -1239,13 +1895,15 @@ func (w responseWriter) ReplyNews(articles []Article) {
 		ctx += fmt.Sprintf(replyArticle, article.Title, article.Description, article.PicUrl, article.Url)
 	}
 	msg := fmt.Sprintf(replyNews, w.replyHeader(), len(articles), ctx)
-	w.replyMsg(msg)
+	w.reply(msg, func() error {
+		return w.PostNews(articles)
+	})
 }
 
 // TransferCustomerService used to tTransfer customer service
 func (w responseWriter) TransferCustomerService(serviceID string) {
 	msg := fmt.Sprintf(transferCustomerService, serviceID, w.fromUserName, time.Now().Unix())
-	w.replyMsg(msg)
+	w.reply(msg, nil)
 }
 
 // PostText used to Post text message